@@ -0,0 +1,227 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/bzip2"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"postlog-sa/filter"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Compressed file signatures
+var (
+	// Rotated file suffix: mail.log.1.gz or mail.log-20240101.gz
+	rotatedRe = regexp.MustCompile(`^(.*?)(?:\.(\d+)|\-(\d{8,10}))?(?:\.gz|\.bz2|\.xz)?$`)
+
+	gzipMagic  = []byte{0x1f, 0x8b}
+	bzip2Magic = []byte("BZh")
+	xzMagic    = []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}
+)
+
+// Log file reader, compressed file is decompressed by the signature
+type logFile struct {
+	io.Reader
+	f *os.File
+	// Decompressor command, there is no xz package in the standard library
+	cmd *exec.Cmd
+}
+
+// Open plain, gzip, bzip2 or xz log file
+func openLog(name string) (this *logFile, err error) {
+	var (
+		r     *bufio.Reader
+		magic []byte
+	)
+
+	this = &logFile{}
+
+	if this.f, err = os.Open(name); err != nil {
+		return nil, err
+	}
+
+	r = bufio.NewReader(this.f)
+	magic, _ = r.Peek(len(xzMagic))
+
+	switch {
+	case bytes.HasPrefix(magic, gzipMagic):
+		this.Reader, err = gzip.NewReader(r)
+
+	case bytes.HasPrefix(magic, bzip2Magic):
+		this.Reader = bzip2.NewReader(r)
+
+	case bytes.HasPrefix(magic, xzMagic):
+		this.cmd = exec.Command("xz", "-dc")
+		this.cmd.Stdin = r
+
+		if this.Reader, err = this.cmd.StdoutPipe(); err == nil {
+			err = this.cmd.Start()
+		}
+
+	default:
+		this.Reader = r
+	}
+
+	if err != nil {
+		this.f.Close()
+
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Close file, decompressor error is returned if any
+func (this *logFile) Close() (err error) {
+	if this.cmd != nil {
+		err = this.cmd.Wait()
+	}
+
+	if e := this.f.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Send lines of the files one by one in the given order, see sortLogs
+func readLogs(names []string, lines chan<- *filter.Line) (err error) {
+	for _, name := range names {
+		if err = readLog(name, lines); err != nil {
+			return fmt.Errorf("%s: %s", name, err.Error())
+		}
+	}
+
+	return nil
+}
+
+func readLog(name string, lines chan<- *filter.Line) (err error) {
+	var (
+		f *logFile
+		r *bufio.Reader
+	)
+
+	if f, err = openLog(name); err != nil {
+		return err
+	}
+
+	r = bufio.NewReader(f)
+
+	for {
+		str, e := r.ReadString('\n')
+
+		if str != "" {
+			lines <- &filter.Line{
+				Text:   strings.TrimSuffix(str, "\n"),
+				Source: name,
+			}
+		}
+
+		if e != nil {
+			if e != io.EOF {
+				err = e
+			}
+
+			break
+		}
+	}
+
+	if e := f.Close(); err == nil {
+		err = e
+	}
+
+	return err
+}
+
+// Sort rotated files from the oldest to the current: mail.log.2.gz,
+// mail.log.1, mail.log. Files of the different logs are kept together
+func sortLogs(names []string) []string {
+	type rotated struct {
+		name,
+		base,
+		date string
+		num int
+	}
+
+	var (
+		list = make([]*rotated, 0, len(names))
+		v    = make([]string, 0, len(names))
+	)
+
+	for _, name := range names {
+		r := &rotated{name: name, base: name}
+
+		if res := rotatedRe.FindStringSubmatch(name); res != nil {
+			r.base = res[1]
+			r.num, _ = strconv.Atoi(res[2])
+			r.date = res[3]
+		}
+
+		list = append(list, r)
+	}
+
+	sort.SliceStable(list, func(i, j int) bool {
+		a, b := list[i], list[j]
+
+		switch {
+		case a.base != b.base:
+			return a.base < b.base
+		// Higher number is older
+		case a.num != b.num:
+			return a.num > b.num
+		// Dated file is older than the current one
+		case a.date != b.date:
+			return b.date == "" || (a.date != "" && a.date < b.date)
+		}
+
+		return false
+	})
+
+	for _, r := range list {
+		v = append(v, r.name)
+	}
+
+	return v
+}
+
+// Read log files through the pipeline and complete threads left in the storage
+func batch(st *filter.Storage, pl *filter.Pipeline, names []string, args ...interface{}) {
+	var (
+		lines = make(chan *filter.Line, 1024)
+	)
+
+	go func() {
+		if err := readLogs(sortLogs(names), lines); err != nil {
+			log.Error(err.Error())
+		}
+
+		close(lines)
+	}()
+
+	pl.Run(lines, args...)
+	st.Flush(args...)
+}
+
+// Print batch result
+func summary(w io.Writer, st *filter.Storage, sm *StmtMap) {
+	var (
+		c    = st.GetCounters()
+		rows uint
+	)
+
+	if sm != nil {
+		rows = sm.GetRows()
+	}
+
+	fmt.Fprintf(w, "Threads: %d, incomplete: %d\n", c.Threads, c.Expired+c.Evicted+c.Flushed)
+	fmt.Fprintf(w, "Bounces: %d, backscatter: %d\n", c.Bounces, c.Backscatter)
+	fmt.Fprintf(w, "Spam verdicts: %d, pending: %d, matched: %d, unmatched: %d\n", c.Verdicts, c.Pending, c.Matched, c.Unmatched)
+	fmt.Fprintf(w, "SQL rows: %d\n", rows)
+}
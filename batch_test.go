@@ -0,0 +1,166 @@
+package main
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"os/exec"
+	"path/filepath"
+	"postlog-sa/filter"
+	"strings"
+	"testing"
+)
+
+// Write lines to the file compressed with gzip
+func writeGzip(t *testing.T, name string, str string) {
+	var buf bytes.Buffer
+
+	w := gzip.NewWriter(&buf)
+	w.Write([]byte(str))
+	w.Close()
+
+	if err := ioutil.WriteFile(name, buf.Bytes(), 0644); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+}
+
+// Compress file with the external command, test is skipped if there is no command
+func compressFile(t *testing.T, cmd string, name string) {
+	if _, err := exec.LookPath(cmd); err != nil {
+		t.Skipf("%s is not found", cmd)
+	}
+
+	if out, err := exec.Command(cmd, "-k", name).CombinedOutput(); err != nil {
+		t.Fatalf("Unexpected error %s: %s", err.Error(), out)
+	}
+}
+
+func TestReadLogs(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		lines = make(chan *filter.Line, 100)
+		names = []string{
+			filepath.Join(dir, "mail.log.2.gz"),
+			filepath.Join(dir, "mail.log.1"),
+		}
+		text []string
+	)
+
+	writeGzip(t, names[0], "line 1\nline 2\n")
+	ioutil.WriteFile(names[1], []byte("line 3\nline 4"), 0644)
+
+	if err := readLogs(names, lines); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+	close(lines)
+
+	for l := range lines {
+		text = append(text, l.Text)
+	}
+
+	if v := strings.Join(text, ","); v != "line 1,line 2,line 3,line 4" {
+		t.Errorf("Expected lines in the file order, but got %s", v)
+	}
+
+	if err := readLogs([]string{filepath.Join(dir, "none")}, lines); err == nil {
+		t.Errorf("Expected error on missing file")
+	}
+}
+
+func TestReadLogsCompressed(t *testing.T) {
+	for _, v := range []struct {
+		cmd, ext string
+	}{
+		{"bzip2", ".bz2"},
+		{"xz", ".xz"},
+	} {
+		t.Run(v.cmd, func(t *testing.T) {
+			var (
+				name  = filepath.Join(t.TempDir(), "mail.log")
+				lines = make(chan *filter.Line, 10)
+			)
+
+			ioutil.WriteFile(name, []byte("line 1\nline 2\n"), 0644)
+			compressFile(t, v.cmd, name)
+
+			if err := readLogs([]string{name + v.ext}, lines); err != nil {
+				t.Fatalf("Unexpected error %s", err.Error())
+			}
+
+			if len(lines) != 2 || (<-lines).Text != "line 1" {
+				t.Errorf("Expected 2 lines, but got %d", len(lines))
+			}
+		})
+	}
+}
+
+func TestSortLogs(t *testing.T) {
+	for _, v := range []struct {
+		names,
+		expected string
+	}{
+		// Shell glob order
+		{
+			"mail.log,mail.log.1,mail.log.10.gz,mail.log.2.gz,mail.log.3.bz2",
+			"mail.log.10.gz,mail.log.3.bz2,mail.log.2.gz,mail.log.1,mail.log",
+		},
+		{
+			"mail.log.1,mail.log,mail.log.2.xz",
+			"mail.log.2.xz,mail.log.1,mail.log",
+		},
+		{
+			"mail.log,mail.log-20260110.gz,mail.log-20260103.gz",
+			"mail.log-20260103.gz,mail.log-20260110.gz,mail.log",
+		},
+		{
+			"mail.log,mail.info.1,mail.log.1,mail.info",
+			"mail.info.1,mail.info,mail.log.1,mail.log",
+		},
+	} {
+		if s := strings.Join(sortLogs(strings.Split(v.names, ",")), ","); s != v.expected {
+			t.Errorf("Expected %s, but got %s", v.expected, s)
+		}
+	}
+}
+
+func TestBatch(t *testing.T) {
+	var (
+		dir   = t.TempDir()
+		names = []string{
+			filepath.Join(dir, "mail.log.1.gz"),
+			filepath.Join(dir, "mail.log"),
+		}
+		st   = filter.NewStorage()
+		pl   = filter.NewPipeline(st, 2)
+		buf  bytes.Buffer
+		done []filter.ThreadFace
+	)
+
+	writeGzip(t, names[0], strings.Join([]string{
+		`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+		`Nov 22 02:24:53 mx postfix/cleanup[6224]: B29AFB08A08A: message-id=<abcd@localhost>`,
+		`Nov 22 02:24:54 mx postfix/smtpd[6223]: C39AFB08A08A: client=unknown[2.2.2.2]`,
+		``,
+	}, "\n"))
+	ioutil.WriteFile(names[1], []byte(strings.Join([]string{
+		`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`,
+		`Nov 22 02:27:05 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+	}, "\n")), 0644)
+
+	st.SetThreadDoneCb(func(v filter.ThreadFace, args ...interface{}) error {
+		done = append(done, v)
+
+		return nil
+	})
+
+	batch(st, pl, names)
+	summary(&buf, st, nil)
+
+	if len(done) != 2 || done[0].GetSpamScore() != 1 || done[1].GetId() != "C39AFB08A08A" {
+		t.Fatalf("Expected spam and flushed threads, but got %v", done)
+	}
+
+	if v := buf.String(); !strings.Contains(v, "Threads: 2, incomplete: 1") || !strings.Contains(v, "Spam verdicts: 1, pending: 0, matched: 0, unmatched: 0") || !strings.Contains(v, "Bounces: 0, backscatter: 0") {
+		t.Errorf("Unexpected summary %s", v)
+	}
+}
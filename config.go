@@ -6,13 +6,18 @@ import (
 	"fmt"
 	"gopkg.in/ini.v1"
 	"os"
+	"path/filepath"
+	"postlog-sa/filter"
 	"reflect"
+	"strings"
+	"time"
 )
 
 var (
 	NAME       = "spam-bug"
 	CONFIGFILE = ""
 	CONSOLELOG = LevelDebug
+	BATCH      = false
 
 	VERSION   string
 	BUILDDATE string
@@ -22,9 +27,15 @@ var (
 
 type Config struct {
 	Tail struct {
-		File string `ini:"file"`
+		File    string `ini:"file"`
+		Workers int    `ini:"workers"`
 	} `ini:"tail"`
 
+	Syslog struct {
+		Listen  string `ini:"listen"`
+		Forward string `ini:"forward"`
+	} `ini:"syslog"`
+
 	DB struct {
 		User     string `ini:"user"`
 		Password string `ini:"pass"`
@@ -37,10 +48,36 @@ type Config struct {
 	} `ini:"db"`
 
 	SQL struct {
-		Query string `ini:"query"`
-		Ok    bool   `json:"-"`
+		Query  string `ini:"query"`
+		Events bool   `ini:"events"`
+		Ok     bool   `json:"-"`
 	} `ini:"sql"`
 
+	Postfix struct {
+		SyslogName string `ini:"syslog_name"`
+	} `ini:"postfix"`
+
+	Amavis struct {
+		Categories string `ini:"spam_categories"`
+	} `ini:"amavis"`
+
+	Storage struct {
+		TTL            time.Duration `ini:"ttl"`
+		MaxThreads     int           `ini:"max_threads"`
+		PendingWindow  time.Duration `ini:"pending_window"`
+		CompleteWindow time.Duration `ini:"complete_window"`
+		ScreenWindow   time.Duration `ini:"screen_window"`
+		SourceIdle     time.Duration `ini:"source_idle"`
+		StateFile      string        `ini:"state_file"`
+		Checkpoint     time.Duration `ini:"checkpoint"`
+	} `ini:"storage"`
+
+	Sasl struct {
+		Window     time.Duration `ini:"window"`
+		Spam       uint          `ini:"spam"`
+		Recipients uint          `ini:"recipients"`
+	} `ini:"sasl"`
+
 	Log struct {
 		Level int    `ini:"level" json:"level"`
 		File  string `ini:"file" json:"filename"`
@@ -49,11 +86,18 @@ type Config struct {
 	Console struct {
 		Level int `json:"level"`
 	}
+
+	// Log parsers state from the `enable' key of the parser section
+	Parsers map[string]bool `ini:"-" json:"-"`
+
+	// User defined regex rules from the `rule.<name>' sections
+	Rules []*filter.Rule `ini:"-" json:"-"`
 }
 
 func init() {
 	flag.StringVar(&CONFIGFILE, "C", "/etc/spam-bug/spam-bug.ini", "Configuration file path required")
 	flag.IntVar(&CONSOLELOG, "v", 0, "Console verbose level output, default 0 - off, 7 - debug")
+	flag.BoolVar(&BATCH, "b", false, "Read log files given as arguments from the oldest and exit")
 }
 
 // Create new configuration
@@ -65,6 +109,19 @@ func NewConfig(file string) (c *Config, err error) {
 
 	c = &Config{}
 
+	// Incomplete threads are kept for a day of log time
+	c.Storage.TTL = 24 * time.Hour
+	// Verdict may be logged before its thread
+	c.Storage.PendingWindow = time.Minute
+	// Postscreen connection without final action is reported after window
+	c.Storage.ScreenWindow = 10 * time.Minute
+	// Log without lines for the idle time does not hold the windows: it is
+	// longer than syslog relay delay and the windows, so a lagging log is
+	// waited for, and short enough to release threads of a stopped log soon
+	c.Storage.SourceIdle = 5 * time.Minute
+	// State with the log position is saved periodically
+	c.Storage.Checkpoint = time.Minute
+
 	if f, err = os.Stat(file); os.IsNotExist(err) {
 		return nil, err
 	} else {
@@ -81,6 +138,24 @@ func NewConfig(file string) (c *Config, err error) {
 		if err = i.MapTo(c); err != nil {
 			return nil, err
 		}
+
+		c.Parsers = make(map[string]bool)
+
+		for _, s := range i.Sections() {
+			if s.HasKey("enable") {
+				c.Parsers[s.Name()] = s.Key("enable").MustBool(true)
+			}
+
+			if strings.HasPrefix(s.Name(), "rule.") {
+				var r *filter.Rule
+
+				if r, err = filter.NewRule(s.Name(), s.Key("kind").String(), s.Key("regex").String()); err != nil {
+					return nil, err
+				}
+
+				c.Rules = append(c.Rules, r)
+			}
+		}
 	}
 
 	if c.Log.File != "" {
@@ -112,6 +187,50 @@ func (this *Config) CanSql() bool {
 	return this.DB.Ok && this.SQL.Ok
 }
 
+// Get comma separated log files, glob patterns are expanded. File which
+// does not exist yet is kept to be followed when it appears
+func (this *Config) GetFiles() (list []string) {
+	var (
+		seen = make(map[string]bool)
+	)
+
+	for _, v := range strings.Split(this.Tail.File, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+
+		names, err := filepath.Glob(v)
+		if err != nil || len(names) == 0 {
+			names = []string{v}
+		}
+
+		for _, name := range names {
+			if !seen[name] {
+				seen[name] = true
+				list = append(list, name)
+			}
+		}
+	}
+
+	return list
+}
+
+// Get comma separated syslog listen addresses
+func (this *Config) GetListen() (list []string) {
+	for _, v := range strings.Split(this.Syslog.Listen, ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			list = append(list, v)
+		}
+	}
+
+	return list
+}
+
+// Check if authenticated users activity should be tracked
+func (this *Config) CanSasl() bool {
+	return this.Sasl.Window > 0 && (this.Sasl.Spam > 0 || this.Sasl.Recipients > 0)
+}
+
 // Convert part of the configuration struct or whole object to json string
 func (this *Config) GetJson(s string) (c string) {
 	var (
@@ -4,7 +4,9 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
+	"path/filepath"
 	"regexp"
+	"strings"
 	"testing"
 )
 
@@ -220,10 +222,15 @@ file =
 level = 
 `
 	cfg_json = fmt.Sprintf(
-		`{"Tail":%s,"DB":%s,"SQL":%s,"Log":%s,"Console":%s}`,
-		`{"File":""}`,
+		`{"Tail":%s,"Syslog":%s,"DB":%s,"SQL":%s,"Postfix":%s,"Amavis":%s,"Storage":%s,"Sasl":%s,"Log":%s,"Console":%s}`,
+		`{"File":"","Workers":0}`,
+		`{"Listen":"","Forward":""}`,
 		`{"User":"","Password":"","Host":"","Port":0,"Name":"","Charset":"","Location":""}`,
-		`{"Query":""}`,
+		`{"Query":"","Events":false}`,
+		`{"SyslogName":""}`,
+		`{"Categories":""}`,
+		`{"TTL":86400000000000,"MaxThreads":0,"PendingWindow":60000000000,"CompleteWindow":0,"ScreenWindow":600000000000,"SourceIdle":300000000000,"StateFile":"","Checkpoint":60000000000}`,
+		`{"Window":0,"Spam":0,"Recipients":0}`,
 		`{"level":0,"filename":""}`,
 		`{"level":0}`,
 	)
@@ -299,3 +306,164 @@ file = %s%s
 		t.Fatalf("Excpeted log data '%s', but got '%s'", cfg_json, v)
 	}
 }
+
+func TestConfig_SaslRead(t *testing.T) {
+	var (
+		file     *os.File
+		err      error
+		ini_mock string
+		cfg_json string
+		cfg      *Config
+	)
+
+	ini_mock = `
+# Authenticated users activity
+[sasl]
+window = 1h
+spam = 5
+recipients = 500
+`
+	cfg_json = `{"Window":3600000000000,"Spam":5,"Recipients":500}`
+
+	if file, err = ioutil.TempFile("", file_name); err != nil {
+		t.Fatalf("Expected temporary file, but got error: %s", err.Error())
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err = file.WriteString(ini_mock); err != nil {
+		t.Fatalf("Can't write file content. Error: %s", err.Error())
+	}
+
+	file.Close()
+
+	if cfg, err = NewConfig(file.Name()); err != nil {
+		t.Fatalf("Expected to open file %s, but got error: %s", file.Name(), err.Error())
+	}
+
+	if v := cfg.GetJson("Sasl"); v != cfg_json {
+		t.Logf("Configuration: %s", ini_mock)
+		t.Fatalf("Excpeted sasl data '%s', but got '%s'", cfg_json, v)
+	}
+
+	if !cfg.CanSasl() {
+		t.Fatalf("Expected sasl detector is enabled")
+	}
+}
+
+func TestConfig_ParsersRead(t *testing.T) {
+	var (
+		file     *os.File
+		err      error
+		ini_mock string
+		cfg      *Config
+	)
+
+	ini_mock = `
+[spamd]
+enable = 0
+
+[amavis]
+enable = 1
+spam_categories = SPAM
+
+[rspamd]
+`
+
+	if file, err = ioutil.TempFile("", file_name); err != nil {
+		t.Fatalf("Expected temporary file, but got error: %s", err.Error())
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err = file.WriteString(ini_mock); err != nil {
+		t.Fatalf("Can't write file content. Error: %s", err.Error())
+	}
+
+	file.Close()
+
+	if cfg, err = NewConfig(file.Name()); err != nil {
+		t.Fatalf("Expected to open file %s, but got error: %s", file.Name(), err.Error())
+	}
+
+	if v, ok := cfg.Parsers["spamd"]; !ok || v {
+		t.Errorf("Expected spamd parser is disabled")
+	}
+
+	if v, ok := cfg.Parsers["amavis"]; !ok || !v {
+		t.Errorf("Expected amavis parser is enabled")
+	}
+
+	if _, ok := cfg.Parsers["rspamd"]; ok {
+		t.Errorf("Expected rspamd parser state is not set")
+	}
+}
+
+func TestConfig_RulesRead(t *testing.T) {
+	var (
+		file *os.File
+		err  error
+		cfg  *Config
+	)
+
+	for i, ini_mock := range []string{
+		"[rule.site]\nregex = `site-filter\\[\\d+\\]: (?P<queue_id>[0-9A-F]+): (?P<category>\\w+) # comment`\n",
+		"[rule.site]\nregex = `site-filter: (?P<queue_id>[0-9A-F]+`\n",
+	} {
+		if file, err = ioutil.TempFile("", file_name); err != nil {
+			t.Fatalf("Expected temporary file, but got error: %s", err.Error())
+		}
+
+		if _, err = file.WriteString(ini_mock); err != nil {
+			t.Fatalf("Can't write file content. Error: %s", err.Error())
+		}
+
+		file.Close()
+
+		cfg, err = NewConfig(file.Name())
+		os.Remove(file.Name())
+
+		switch i {
+		case 0:
+			if err != nil {
+				t.Fatalf("Unexpected error %s", err.Error())
+			}
+
+			if len(cfg.Rules) != 1 || cfg.Rules[0].Name() != "rule.site" {
+				t.Errorf("Expected rule.site, but got %v", cfg.Rules)
+			}
+
+		case 1:
+			if err == nil {
+				t.Errorf("Expected regex compile error")
+			}
+		}
+	}
+}
+
+func TestConfig_GetFiles(t *testing.T) {
+	var (
+		dir = t.TempDir()
+		cfg = &Config{}
+	)
+
+	for _, v := range []string{"mail.log", "mail.info", "amavis.log"} {
+		ioutil.WriteFile(filepath.Join(dir, v), nil, 0644)
+	}
+
+	cfg.Tail.File = strings.Join([]string{
+		filepath.Join(dir, "mail.*"),
+		filepath.Join(dir, "mail.log"),
+		filepath.Join(dir, "spamd.log"),
+	}, ", ")
+
+	expected := strings.Join([]string{
+		filepath.Join(dir, "mail.info"),
+		filepath.Join(dir, "mail.log"),
+		filepath.Join(dir, "spamd.log"),
+	}, ",")
+
+	if v := strings.Join(cfg.GetFiles(), ","); v != expected {
+		t.Errorf("Expected files %s, but got %s", expected, v)
+	}
+}
@@ -130,6 +130,15 @@ func TestParseStatmentQuery(t *testing.T) {
 			"INSERT INTO `table`(`field`) VALUES(?m)",
 			"INSERT INTO `table`(`field`) VALUES(?s)",
 			"INSERT INTO `table`(`field`) VALUES(?t)",
+			"INSERT INTO `table`(`field`) VALUES(?r)",
+			"INSERT INTO `table`(`field`) VALUES(?h)",
+			"INSERT INTO `table`(`field`) VALUES(?q)",
+			"INSERT INTO `table`(`field`) VALUES(?l)",
+			"INSERT INTO `table`(`field`) VALUES(?v)",
+			"INSERT INTO `table`(`field`) VALUES(?a)",
+			"INSERT INTO `table`(`field`) VALUES(?p)",
+			"INSERT INTO `table`(`field`) VALUES(?u)",
+			"INSERT INTO `table`(`field`) VALUES(?b)",
 		}
 
 		r []rune
@@ -163,6 +172,24 @@ func TestParseStatmentQuery(t *testing.T) {
 			r = []rune{115}
 		case 5:
 			r = []rune{116}
+		case 6:
+			r = []rune{114}
+		case 7:
+			r = []rune{104}
+		case 8:
+			r = []rune{113}
+		case 9:
+			r = []rune{108}
+		case 10:
+			r = []rune{118}
+		case 11:
+			r = []rune{97}
+		case 12:
+			r = []rune{112}
+		case 13:
+			r = []rune{117}
+		case 14:
+			r = []rune{98}
 
 		default:
 			r = make([]rune, 0)
@@ -238,10 +265,17 @@ func TestStatmentCall(t *testing.T) {
 		err  error
 	)
 
+	// Log line year is guessed, line can not be logged in the future
+	created := time.Date(time.Now().Year(), 12, 4, 10, 33, 24, 0, time.Local)
+	if created.After(time.Now().Add(24 * time.Hour)) {
+		created = created.AddDate(-1, 0, 0)
+	}
+	filter.SetTimeReference(time.Time{})
+
 	db, mock := InitDBMock(t)
 	mock.ExpectPrepare("INSERT").
 		ExpectExec().
-		WithArgs("simonova@yahoo.com", time.Now().Format("2006") + "-12-04 10:33:24", "1.7.1.1").
+		WithArgs("simonova@yahoo.com", created.Format("2006-01-02 15:04:05"), "1.7.1.1").
 		WillReturnResult(sqlmock.NewResult(1, 0))
 
 	stmt, err = NewStmt(db, "INSERT INTO `table`(`a`) VALUES(?f, ?t, ?c)")
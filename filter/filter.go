@@ -1,6 +1,8 @@
 package filter
 
 import (
+	"net"
+	"path"
 	"regexp"
 	"strings"
 	"time"
@@ -9,17 +11,61 @@ import (
 var (
 	amavisdRe,
 	amavisEmlRe,
+	amavisHitsRe,
 	amavisQueueRe,
+	amavisTestsRe,
+	clamavMidRe,
+	clamavMilterRe,
+	clamdRe,
 	clientRe,
 	fromRe,
 	messageIdRe,
+	notificationRe,
+	pickupRe,
 	postfixRe,
 	queuedasRe,
+	rcptRe,
+	rejectRe,
+	rejectParamRe,
+	rspamdRe,
+	saslRe,
+	rspamdIdRe,
+	rspamdOptsRe,
+	rspamdQidRe,
+	rspamdRcptRe,
+	rspamdResultRe,
+	rspamdSymbolRe,
+	screenRe,
+	screenActionRe,
+	screenDnsblRe,
+	screenListedRe,
 	smtpstatusRe,
 	spamdRe,
+	spamdRequiredRe,
 	timeRe *regexp.Regexp
 
 	emailTpl string = `[a-zA-Z0-9_.+-]+@[a-zA-Z0-9-]+\.[a-zA-Z0-9-.]+`
+	// IPv4 or IPv6 address with optional address literal prefix
+	ipTpl string = `(?:IPv6\:)?[0-9a-fA-F\:\.]*[0-9a-fA-F](?:%[a-zA-Z0-9_\.\-]+)?`
+
+	// Postfix instances syslog_name patterns
+	syslogNames = []string{"postfix", "postfix-*", "postfix/*"}
+
+	// Services which log queue id, delivery agents are added on init
+	queueServices = []string{"smtpd", "cleanup", "qmgr", "pickup", "bounce", "postsuper"}
+
+	// Services of the line kinds, lists are not allocated per line
+	cleanupServices = []string{"cleanup"}
+	removeServices  = []string{"qmgr", "postsuper"}
+	clientServices  = []string{"smtpd", "pickup"}
+	bounceServices  = []string{"bounce"}
+	pickupServices  = []string{"pickup"}
+	smtpdServices   = []string{"smtpd"}
+	qmgrServices    = []string{"qmgr"}
+	relayServices   = []string{"smtp", "lmtp"}
+
+	// Local submission client
+	localClient = Client{Name: "localhost", IP: "127.0.0.1"}
 )
 
 type Client struct {
@@ -28,48 +74,117 @@ type Client struct {
 }
 
 func init() {
+	queueServices = append(queueServices, deliveryAgents...)
+
 	// Pickup amavis log entry with statistics
-	amavisdRe = regexp.MustCompile(`amavis\[(\d+)]\: \([0-9\-]+\) \w+ (CLEAN|SPAM|SPAMMY|BANNED).*\[\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3}\] \<([a-zA-Z0-9-_\.@]{1,})\> \-\> (.*)`)
+	amavisdRe = regexp.MustCompile(`amavis\[(\d+)\]\: \([0-9\-]+\) ([\w\-]+) ([A-Z]+(?:\-[A-Z]+)*)(?:\-\d+)?(?: \(([^\)]*)\))?(?: \{([^\}]*)\})?.*\[` + ipTpl + `\] \<([a-zA-Z0-9-_\.@\+]*)\> \-\> (.*)`)
 	// Find emails list in the amavis statistics message
 	amavisEmlRe = regexp.MustCompile(`(\<` + emailTpl + `\>\,){1,}`)
+	// Find spam score in amavis message
+	amavisHitsRe = regexp.MustCompile(`Hits\: (\-?[\d\.]+)`)
+	// Find spam tests in amavis message
+	amavisTestsRe = regexp.MustCompile(`Tests\: \[([^\]]*)\]`)
 	// Find queued_as parameter in amavis message
 	amavisQueueRe = regexp.MustCompile(`([Qq]ueue[_\-IDdas]+)\: ([a-zA-Z0-9]+)\,`)
+	// Clamav-milter infected message with postfix queue id
+	clamavMilterRe = regexp.MustCompile(`clamav\-milter\[\d+\]\: Message ([a-zA-Z0-9]+) (.*)infected by (.+)$`)
+	// Clamav-milter message id
+	clamavMidRe = regexp.MustCompile(`message\-id '\<?([^'\>]*)\>?'`)
+	// Clamd found message
+	clamdRe = regexp.MustCompile(`clamd\[\d+\]\: (.+)\: (\S+) FOUND`)
 	// Pick up client information from the postfix message
-	clientRe = regexp.MustCompile(`client\=([a-zA-Z0-9-_\.]+)\[(\d{1,3}\.\d{1,3}\.\d{1,3}\.\d{1,3})\]`)
+	clientRe = regexp.MustCompile(`client\=([a-zA-Z0-9-_\.]+)\[(` + ipTpl + `)\]`)
 	// Pick up email data from postfix message
 	fromRe = regexp.MustCompile(`from\=\<(` + emailTpl + `)\>,`)
 	// Common pattern to pick up message id from amavis or spamd message
 	messageIdRe = regexp.MustCompile(`[Mm]essage\-[Ii][Dd](\=|\:)[\s\<]*([a-zA-Z0-9\-\_\.@\$]{1,})\>*`)
+	// Bounce daemon notification with the new queue id
+	notificationRe = regexp.MustCompile(`^(?:sender|postmaster) (?:non\-delivery|delivery status|delay) notification\: ([a-zA-Z0-9]+)`)
+	// Pickup local submission
+	pickupRe = regexp.MustCompile(`uid\=(\d+) from\=\<([^\>]*)\>`)
 	// Postfix modules log messages
-	postfixRe = regexp.MustCompile(` postfix\/(\w+)\[(\d+)\]\: ([a-zA-Z0-9]+)\: (.*)`)
+	postfixRe = regexp.MustCompile(` ([\w\.\-]+(?:\/[\w\.\-]+)*)\/(\w+)\[(\d+)\]\: ([a-zA-Z0-9]+)\: (.*)`)
 	// Take message id from queued as string
 	queuedasRe = regexp.MustCompile(`queued as ([a-zA-Z0-9]{1,})\)`)
+	// Recipient delivery attempt
+	rcptRe = regexp.MustCompile(`to\=\<([^\>]*)\>, (?:orig_to\=\<([^\>]*)\>, )?relay\=([^\s,]+), (?:conn_use\=\d+, )?delay\=([\d\.]+), (?:delays\=[\d\.\/]+, )?dsn\=([\d\.]+)`)
+	// Smtpd reject message without queue id
+	rejectRe = regexp.MustCompile(`^(?:milter\-)?reject\: ([\w\-]+) from ([a-zA-Z0-9-_\.]*)\[(` + ipTpl + `)\](?:\:\d+)?\: (?:(\d{3}) )?(?:(\d\.\d{1,3}\.\d{1,3}) )?(.*)$`)
+	// Reject message parameters: from, to, proto, helo
+	rejectParamRe = regexp.MustCompile(`(\w+)\=\<?([^\s\>,]*)\>?`)
+	// Rspamd task log message
+	rspamdRe = regexp.MustCompile(`rspamd_task_write_log\: (.*)`)
+	// Rspamd message id
+	rspamdIdRe = regexp.MustCompile(`(?:^|[\s,])m?id\: \<([^\>]*)\>`)
+	// Rspamd symbol options
+	rspamdOptsRe = regexp.MustCompile(`\{[^\}]*\}`)
+	// Rspamd postfix queue id
+	rspamdQidRe = regexp.MustCompile(`(?:^|[\s,])qid\: \<([^\>]*)\>`)
+	// Rspamd recipients
+	rspamdRcptRe = regexp.MustCompile(`(?:^|[\s,])rcpts?\: ((?:\<[^\>]*\>,?)+)`)
+	// Rspamd verdict: spam flag, action, score, required score and symbols
+	rspamdResultRe = regexp.MustCompile(`\([\w\-]+\: ([TFS]) \(([\w ]+)\)\: \[(\-?[\d\.]+)\/(\-?[\d\.]+)\] \[(.*?)\]\)`)
+	// Rspamd symbol name
+	rspamdSymbolRe = regexp.MustCompile(`([A-Za-z0-9_]+)\(`)
+	// Postscreen and dnsblog log messages
+	screenRe = regexp.MustCompile(` ([\w\.\-]+(?:\/[\w\.\-]+)*)\/(postscreen|dnsblog)\[(\d+)\]\: (.*)`)
+	// Postscreen connection action with client address
+	screenActionRe = regexp.MustCompile(`^(CONNECT|PASS NEW|PASS OLD|DISCONNECT|WHITELISTED|BLACKLISTED|PREGREET|HANGUP|BARE NEWLINE|NON\-SMTP COMMAND|COMMAND PIPELINING|COMMAND TIME LIMIT|COMMAND COUNT LIMIT|COMMAND LENGTH LIMIT)\b.*?\[(` + ipTpl + `)\]\:\d+`)
+	// Postscreen DNSBL rank
+	screenDnsblRe = regexp.MustCompile(`^DNSBL rank (\d+) for \[(` + ipTpl + `)\]\:\d+`)
+	// Dnsblog listed address
+	screenListedRe = regexp.MustCompile(`^addr (` + ipTpl + `) listed by domain (\S+) as (\S+)`)
+	// Smtpd authenticated client
+	saslRe = regexp.MustCompile(`sasl_method\=([\w\-]+)(?:, sasl_username\=([^\s,]+))?`)
 	// Get smtp status
-	smtpstatusRe = regexp.MustCompile(`status=(sent|deferred)`)
+	smtpstatusRe = regexp.MustCompile(`status=(sent|deferred|bounced|expired)`)
 	// Spamd log message
-	spamdRe = regexp.MustCompile(`spamd\[(\d+)\]: spamd: result: ([\.Y]{1}) ([\-\d]{1,}) - .*,mid\=\<*([a-zA-Z0-9-_\.@\$]{1,})\>*,`)
-	// Log line time
-	timeRe = regexp.MustCompile(`^(\w+\s+\d{1,2} \d{1,2}:\d{1,2}:\d{1,2})`)
+	spamdRe = regexp.MustCompile(`spamd\[(\d+)\]: spamd: result: ([\.Y]{1}) ([\-\d\.]{1,}) - (\S*) .*,mid\=\<*([a-zA-Z0-9-_\.@\$]{1,})\>*,`)
+	// Spamd required score
+	spamdRequiredRe = regexp.MustCompile(`required_score\=(\-?[\d\.]+)`)
+	// Log line time: RFC 3339 (optionally with RFC 5424 header) or traditional BSD stamp
+	timeRe = regexp.MustCompile(`^(?:\<\d{1,3}\>\d{1,2} )?(\d{4}\-\d{2}\-\d{2}T\d{2}\:\d{2}\:\d{2}(?:\.\d{1,9})?(?:Z|[\+\-]\d{2}\:\d{2})|\w+\s+\d{1,2} \d{1,2}:\d{1,2}:\d{1,2})`)
 }
 
-// Check string if there is postfix system record
-func IsPostfix(str string, service []string) (ok bool, res []string) {
-	res = postfixRe.FindStringSubmatch(str)
+// Set postfix instances syslog_name patterns, pattern syntax is path.Match
+func SetSyslogNames(v []string) {
+	syslogNames = make([]string, 0, len(v))
+
+	for _, n := range v {
+		if n = strings.TrimSpace(n); n != "" {
+			syslogNames = append(syslogNames, n)
+		}
+	}
+}
 
-	if len(res) == 0 {
-		return false, res
+// Check if syslog_name belongs to postfix instance
+func IsSyslogName(name string) bool {
+	for _, p := range syslogNames {
+		if ok, _ := path.Match(p, name); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Check string if there is postfix system record, result items are
+// service, process id, queue id, message and instance syslog_name
+func IsPostfix(str string, service []string) (ok bool, res []string) {
+	if res = postfixRe.FindStringSubmatch(str); len(res) < 6 || !IsSyslogName(res[1]) {
+		return false, []string{}
 	}
 
 	// The first item is the whole regexp expression
+	res = []string{res[0], res[2], res[3], res[4], res[5], res[1]}
+
 	if len(service) == 0 {
 		return true, res
 	}
 
-	if len(res) > 1 {
-		for _, v := range service {
-			if res[1] == v {
-				return true, res
-			}
+	for _, v := range service {
+		if res[1] == v {
+			return true, res
 		}
 	}
 
@@ -78,13 +193,14 @@ func IsPostfix(str string, service []string) (ok bool, res []string) {
 
 // Check string if there is postfix cleanup process
 func IsCleanup(str string) bool {
-	ok, _ := IsPostfix(str, []string{"cleanup"})
+	ok, _ := IsPostfix(str, cleanupServices)
 	return ok
 }
 
-// Check string if there is mail thread item removed
+// Check string if there is mail thread item removed by qmgr
+// or deleted from the queue by postsuper
 func IsRemoved(str string) bool {
-	ok, res := IsPostfix(str, []string{"qmgr"})
+	ok, res := IsPostfix(str, removeServices)
 
 	if !ok || len(res) < 5 {
 		return false
@@ -101,12 +217,17 @@ func getId(str string) (v string, err error) {
 		ok  bool
 	)
 
-	ok, res = IsPostfix(str, []string{"smtpd", "smtp", "cleanup", "qmgr", "pipe"})
+	ok, res = IsPostfix(str, queueServices)
 	// Is not postfix message
 	if !ok || len(res) < 4 {
 		return v, ErrorStrFormatNotSupported
 	}
 
+	// Postsuper summary lines look like queue id, e.g. Deleted: 1 message
+	if res[1] == "postsuper" && !IsRemoved(str) {
+		return v, ErrorStrFormatNotSupported
+	}
+
 	res[3] = strings.ToUpper(res[3])
 
 	switch res[3] {
@@ -126,21 +247,7 @@ func getId(str string) (v string, err error) {
 
 // Get time object from string
 func getTime(str string) (t time.Time, err error) {
-	var (
-		res []string
-	)
-
-	res = timeRe.FindStringSubmatch(str)
-	if len(res) < 2 {
-		return t, ErrorStrFormatNotSupported
-	}
-
-	t, err = time.Parse(time.Stamp, res[1])
-	if err == nil && t.Year() == 0 {
-		t = t.AddDate(time.Now().Year(), 0, 0)
-	}
-
-	return
+	return lineTime.parse(str, false)
 }
 
 // Get connected client identity
@@ -150,12 +257,30 @@ func getClient(str string) (v *Client) {
 		ok  bool
 	)
 
-	ok, res = IsPostfix(str, []string{"smtpd"})
+	ok, res = IsPostfix(str, clientServices)
 	// Is not postfix message
 	if !ok || len(res) < 5 {
 		return nil
 	}
 
+	// Mail was submitted with sendmail command
+	if res[1] == "pickup" {
+		if !pickupRe.MatchString(res[4]) {
+			return nil
+		}
+
+		v = &Client{
+			Name: localClient.Name,
+			IP:   localClient.IP,
+		}
+
+		if t, err := getTime(str); err == nil {
+			v.At = t
+		}
+
+		return v
+	}
+
 	res = clientRe.FindStringSubmatch(res[4])
 
 	if len(res) < 3 {
@@ -164,7 +289,7 @@ func getClient(str string) (v *Client) {
 
 	v = &Client{
 		Name: res[1],
-		IP:   res[2],
+		IP:   trimIp(res[2]),
 	}
 
 	// Take time when mail was accepted for the delivery
@@ -175,6 +300,57 @@ func getClient(str string) (v *Client) {
 	return v
 }
 
+// Get postfix instance syslog_name
+func getInstance(str string) (v string) {
+	if ok, res := IsPostfix(str, nil); ok {
+		v = res[5]
+	}
+
+	return v
+}
+
+// Get queue id of the notification created by bounce daemon
+func getBounceId(str string) (v string) {
+	ok, res := IsPostfix(str, bounceServices)
+	if !ok || len(res) < 5 {
+		return v
+	}
+
+	if res = notificationRe.FindStringSubmatch(res[4]); len(res) > 1 {
+		v = strings.ToUpper(res[1])
+	}
+
+	return v
+}
+
+// Get local user id of the mail submitted with sendmail command
+func getUid(str string) (v string) {
+	ok, res := IsPostfix(str, pickupServices)
+	if !ok || len(res) < 5 {
+		return v
+	}
+
+	if res = pickupRe.FindStringSubmatch(res[4]); len(res) > 1 {
+		v = res[1]
+	}
+
+	return v
+}
+
+// Get SASL method and user name of authenticated client
+func getSasl(str string) (method, user string) {
+	ok, res := IsPostfix(str, smtpdServices)
+	if !ok || len(res) < 5 {
+		return
+	}
+
+	if res = saslRe.FindStringSubmatch(res[4]); len(res) > 2 {
+		method, user = res[1], res[2]
+	}
+
+	return
+}
+
 // Get message identity from cleanup service
 func getMessageId(str string) (v string) {
 	var strs []string = messageIdRe.FindStringSubmatch(str)
@@ -199,7 +375,7 @@ func getIdQueuedAs(str string) (v string) {
 
 // Get from address
 func getFrom(str string) (v string) {
-	ok, res := IsPostfix(str, []string{"qmgr"})
+	ok, res := IsPostfix(str, qmgrServices)
 	if !ok || len(res) < 5 {
 		return v
 	}
@@ -211,9 +387,9 @@ func getFrom(str string) (v string) {
 	return v
 }
 
-// Get smtp status
+// Get delivery status
 func getSmtpStatus(str string) (v string) {
-	ok, res := IsPostfix(str, []string{"smtp"})
+	ok, res := IsPostfix(str, deliveryAgents)
 
 	if !ok || len(res) < 5 {
 		return v
@@ -225,3 +401,53 @@ func getSmtpStatus(str string) (v string) {
 
 	return v
 }
+
+// Remove address literal prefix and zone index from the ip string
+func trimIp(str string) string {
+	if len(str) > 5 && strings.EqualFold(str[:5], "IPv6:") {
+		str = str[5:]
+	}
+
+	if i := strings.IndexByte(str, '%'); i > -1 {
+		str = str[:i]
+	}
+
+	return str
+}
+
+// Get canonical ip address string, string is returned as is
+// if it is not valid address
+func normalizeIp(str string) string {
+	str = trimIp(str)
+
+	if ip := net.ParseIP(str); ip != nil {
+		return ip.String()
+	}
+
+	return str
+}
+
+// Get client address in the canonical form
+func (this *Client) GetIp() string {
+	return normalizeIp(this.IP)
+}
+
+// Check if client is connected over IPv6
+func (this *Client) IsIPv6() bool {
+	ip := net.ParseIP(trimIp(this.IP))
+
+	return ip != nil && ip.To4() == nil
+}
+
+// Check if qmgr returned mail to sender after the maximal queue lifetime
+func isExpired(str string) bool {
+	ok, res := IsPostfix(str, qmgrServices)
+
+	if !ok || len(res) < 5 {
+		return false
+	}
+
+	res = smtpstatusRe.FindStringSubmatch(res[4])
+
+	return len(res) > 1 && res[1] == StatusExpired
+}
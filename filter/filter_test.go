@@ -1,6 +1,15 @@
 package filter
 
 import (
+	"bytes"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -182,6 +191,72 @@ func TestGetClient(t *testing.T) {
 	}
 }
 
+func TestGetClientIPv6(t *testing.T) {
+	var m = []string{
+		`Nov 22 01:45:57 mx postfix/smtpd[5910]: A2CAFB08A049: client=unknown[2001:db8::1]`,
+		`Nov 22 02:08:42 mx postfix/smtpd[6223]: BDCA3B08A08A: client=mail.some.net[IPv6:2001:0DB8:0000:0000:0000:0000:0000:0010]`,
+		`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[::ffff:1.2.3.4], sasl_method=PLAIN, sasl_username=abcs@domain.com`,
+	}
+
+	for i, v := range m {
+		r := getClient(v)
+
+		if r == nil {
+			t.Errorf("Not nil value expected at %d", i)
+			continue
+		}
+
+		switch i {
+		case 0:
+			if r.IP != "2001:db8::1" {
+				t.Errorf("Expected value %s, but got %s", "2001:db8::1", r.IP)
+			}
+
+			if !r.IsIPv6() {
+				t.Errorf("Expected IPv6 client")
+			}
+
+		case 1:
+			if r.Name != "mail.some.net" {
+				t.Errorf("Expected value %s, but got %s", "mail.some.net", r.Name)
+			}
+
+			if v := r.GetIp(); v != "2001:db8::10" {
+				t.Errorf("Expected value %s, but got %s", "2001:db8::10", v)
+			}
+
+		case 2:
+			if v := r.GetIp(); v != "1.2.3.4" {
+				t.Errorf("Expected value %s, but got %s", "1.2.3.4", v)
+			}
+
+			if r.IsIPv6() {
+				t.Errorf("Expected IPv4 client")
+			}
+		}
+	}
+}
+
+func TestMailThreadFromIpNormalized(t *testing.T) {
+	var m = map[string]string{
+		`Nov 22 01:45:57 mx postfix/smtpd[5910]: A2CAFB08A049: client=unknown[2001:DB8:0:0::1]`: "2001:db8::1",
+		`Nov 22 01:45:57 mx postfix/smtpd[5910]: A2CAFB08A049: client=unknown[1.1.1.1]`:         "1.1.1.1",
+	}
+
+	for l, ip := range m {
+		h, err := NewMailThread(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		if v := h.GetFromIp(); v != ip {
+			t.Errorf("Expected client ip %s, but got %s", ip, v)
+		}
+	}
+}
+
 func TestGetMessageId(t *testing.T) {
 	var m = []string{
 		`Nov 22 07:59:12 mx postfix/cleanup[15917]: B1B8DB08A08B: message-id=<E1a0Mks-0000Yl-1x@localhost>`,
@@ -454,6 +529,30 @@ func TestGetAmavisSpamReport(t *testing.T) {
 	}
 }
 
+func TestGetAmavisSpamReportIPv6(t *testing.T) {
+	var m = []string{
+		`Dec  2 16:53:57 mx amavis[30290]: (30290-03) Passed SPAMMY {RelayedTaggedInbound}, [2001:db8::1]:49199 [2001:db8::1] <dashapopovich@yahoo.com> -> <ko@foo.net>,<sa@foo.net>, Queue-ID: 33F124562005, Message-ID: <4FB5F6D3A87C5EFD21246DD33739E940@ip-7-77-51-20.bb.netby.net>, mail_id: Tq0EZ1qm6_xb, Hits: 12.525, size: 34901, queued_as: E27B04562007, 667 ms`,
+		`Dec  2 16:53:57 mx amavis[30290]: (30290-03) Passed SPAM {RelayedTaggedInbound}, [IPv6:2001:db8::1]:49199 [IPv6:2001:db8::1] <dashapopovich@yahoo.com> -> <ko@foo.net>,<sa@foo.net>, Queue-ID: 33F124562005, Message-ID: <4FB5F6D3A87C5EFD21246DD33739E940@ip-7-77-51-20.bb.netby.net>, mail_id: Tq0EZ1qm6_xb, Hits: 12.525, size: 34901, queued_as: E27B04562007, 667 ms`,
+	}
+
+	for _, v := range m {
+		f, err := getAmavisd(v)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		if f.Score != 2 {
+			t.Errorf("Expected score %d, but got %d", 2, f.Score)
+		}
+
+		if f.QueuedAs != "E27B04562007" {
+			t.Errorf("Expected queued_as %s, but got %s", "E27B04562007", f.QueuedAs)
+		}
+	}
+}
+
 func TestGetAmavisNotSpamReport(t *testing.T) {
 	var m = []string{
 		`Dec  2 16:53:57 mx amavis[30290]: (30290-03) Passed CLEAN {RelayedTaggedInbound}, [1.1.111.11]:49199 [1.1.111.11] <dashapopovich@yahoo.com> -> <ko@foo.net>,<ko@foo.net>,<sa@foo.net>,<sm@foo.net>,<ret@foo.net>,<lich@foo.net>,<lad@foo.net>,<arov@foo.net>, Queue-ID: 33F124562005, Message-ID: <4FB5F6D3A87C5EFD21246DD33739E940@ip-7-77-51-20.bb.netby.net>, mail_id: Tq0EZ1qm6_xb, Hits: 12.525, size: 34901, queued_as: E27B04562007, 667 ms`,
@@ -570,3 +669,1919 @@ func TestGetLogEntryTime(t *testing.T) {
 		}
 	}
 }
+
+func TestGetLogEntryTimeFormats(t *testing.T) {
+	var (
+		m = []string{
+			`2026-10-18T03:47:02.123456+03:00 mx postfix/smtpd[9477]: connect from unknown[127.0.0.1]`,
+			`2026-10-18T03:47:02Z mx postfix/smtpd[9477]: connect from unknown[127.0.0.1]`,
+			`<22>1 2026-10-18T03:47:02.003-07:00 mx postfix/smtpd 9477 - - connect from unknown[127.0.0.1]`,
+		}
+	)
+
+	for i, l := range m {
+		v, err := getTime(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+			continue
+		}
+
+		switch i {
+		case 0:
+			if ti := v.Format(time.RFC3339Nano); ti != "2026-10-18T03:47:02.123456+03:00" {
+				t.Errorf("Expected parsed time value `2026-10-18T03:47:02.123456+03:00`, but got %s", ti)
+			}
+
+		case 1:
+			if ti := v.Format(time.RFC3339Nano); ti != "2026-10-18T03:47:02Z" {
+				t.Errorf("Expected parsed time value `2026-10-18T03:47:02Z`, but got %s", ti)
+			}
+
+		case 2:
+			if _, off := v.Zone(); off != -7*3600 {
+				t.Errorf("Expected zone offset -07:00, but got %d", off)
+			}
+		}
+	}
+}
+
+func TestTimeParserYearRollover(t *testing.T) {
+	var (
+		m = []string{
+			`Dec 31 23:59:58 mx postfix/smtpd[9477]: connect from unknown[127.0.0.1]`,
+			`Jan  1 00:00:01 mx postfix/smtpd[9477]: connect from unknown[127.0.0.1]`,
+			`Dec 31 23:59:59 mx postfix/smtpd[9477]: disconnect from unknown[127.0.0.1]`,
+		}
+
+		p = NewTimeParser(time.UTC)
+	)
+
+	p.SetReference(time.Date(2025, 12, 31, 23, 0, 0, 0, time.UTC))
+
+	for i, l := range m {
+		v, err := p.Parse(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error: %s", err.Error())
+			continue
+		}
+
+		switch i {
+		case 0, 2:
+			if v.Year() != 2025 {
+				t.Errorf("Expected year 2025, but got %d", v.Year())
+			}
+
+		case 1:
+			if v.Year() != 2026 {
+				t.Errorf("Expected year 2026, but got %d", v.Year())
+			}
+		}
+	}
+}
+
+func TestTimeParserFutureStamp(t *testing.T) {
+	var (
+		p   = NewTimeParser(time.UTC)
+		now = time.Now().UTC()
+		ts  = now.AddDate(0, 0, 7)
+	)
+
+	v, err := p.Parse(ts.Format(time.Stamp) + ` mx postfix/qmgr[8015]: D549FB08A08B: removed`)
+
+	if err != nil {
+		t.Fatalf("Unexpected error: %s", err.Error())
+	}
+
+	if v.After(now) == true {
+		t.Errorf("Expected time in the past, but got %s", v.Format(time.RFC3339))
+	}
+}
+
+func TestNewReject(t *testing.T) {
+	var m = []string{
+		`Nov 22 03:47:02 mx postfix/smtpd[9032]: NOQUEUE: reject: RCPT from unknown[1.2.3.4]: 554 5.7.1 Service unavailable; Client host [1.2.3.4] blocked using zen.spamhaus.org; https://www.spamhaus.org/query/ip/1.2.3.4; from=<spam@foo.net> to=<user@some.net> proto=ESMTP helo=<bot.foo.net>`,
+		`Nov 22 03:47:02 mx postfix/smtpd[9032]: NOQUEUE: reject: RCPT from mail.foo.net[2001:db8::1]: 550 5.1.1 <nouser@some.net>: Recipient address rejected: User unknown in virtual mailbox table; from=<> to=<nouser@some.net> proto=ESMTP helo=<mail.foo.net>`,
+		`Nov 22 03:47:02 mx postfix/smtpd[9032]: NOQUEUE: reject: CONNECT from unknown[1.2.3.4]: 554 5.7.1 <unknown[1.2.3.4]>: Client host rejected: Access denied; proto=SMTP`,
+		`Nov 22 03:47:02 mx postfix/smtpd[9032]: D549FB08A08B: client=unknown[1.2.3.4]`,
+		`Nov 22 03:47:02 mx postfix/smtpd[9032]: warning: hostname 1-2-3-4.foo.net does not resolve to address 1.2.3.4`,
+	}
+
+	for i, l := range m {
+		r, err := NewReject(l)
+
+		switch i {
+		case 0:
+			if err != nil {
+				t.Errorf("Unexpected error %s", err.Error())
+				continue
+			}
+
+			if r.Stage != "RCPT" || r.Code != "554" || r.Dsn != "5.7.1" {
+				t.Errorf("Unexpected stage and code values %s %s %s", r.Stage, r.Code, r.Dsn)
+			}
+
+			if r.Reason != "Service unavailable; Client host [1.2.3.4] blocked using zen.spamhaus.org; https://www.spamhaus.org/query/ip/1.2.3.4" {
+				t.Errorf("Unexpected reason %s", r.Reason)
+			}
+
+			if r.From != "spam@foo.net" || r.To != "user@some.net" || r.Helo != "bot.foo.net" || r.Proto != "ESMTP" {
+				t.Errorf("Unexpected parameters %v", r)
+			}
+
+			if r.GetFromIp() != "1.2.3.4" {
+				t.Errorf("Expected client ip 1.2.3.4, but got %s", r.GetFromIp())
+			}
+
+			if x := r.GetTime().Format(time.Stamp); x != "Nov 22 03:47:02" {
+				t.Errorf("Expected time %s, but got %s", "Nov 22 03:47:02", x)
+			}
+
+		case 1:
+			if err != nil {
+				t.Errorf("Unexpected error %s", err.Error())
+				continue
+			}
+
+			if r.Client.Name != "mail.foo.net" || r.GetFromIp() != "2001:db8::1" {
+				t.Errorf("Unexpected client %v", r.Client)
+			}
+
+			if r.From != "" || r.To != "nouser@some.net" {
+				t.Errorf("Unexpected envelope from=%s, to=%s", r.From, r.To)
+			}
+
+		case 2:
+			if err != nil {
+				t.Errorf("Unexpected error %s", err.Error())
+				continue
+			}
+
+			if r.Stage != "CONNECT" || r.Proto != "SMTP" {
+				t.Errorf("Unexpected stage %s and proto %s", r.Stage, r.Proto)
+			}
+
+			if r.Reason != "<unknown[1.2.3.4]>: Client host rejected: Access denied" {
+				t.Errorf("Unexpected reason %s", r.Reason)
+			}
+
+		default:
+			if err != ErrorStrFormatNotSupported {
+				t.Errorf("Expected error %s", ErrorStrFormatNotSupported.Error())
+			}
+		}
+	}
+}
+
+func TestGetRecipient(t *testing.T) {
+	var (
+		m = []string{
+			`Dec 27 02:39:24 mx postfix/smtp[15816]: C93CEB08A046: to=<order@arobor.ru>, relay=none, delay=307136, delays=307106/0.02/30/0, dsn=4.4.1, status=deferred (connect to arobor.ru[7.0.7.1]:25: Connection timed out)`,
+			`Nov 22 03:47:13 mx postfix/pipe[9078]: D549FB08A08B: to=<sinovv@domain.com>, relay=dovecot, delay=11, delays=1.3/0.01/0/9.8, dsn=2.0.0, status=sent (delivered via dovecot service)`,
+			`Nov 22 03:47:13 mx postfix/lmtp[9078]: D549FB08A08B: to=<box@domain.com>, orig_to=<alias@domain.com>, relay=mail.domain.com[private/dovecot-lmtp], delay=0.05, delays=0.01/0/0.01/0.03, dsn=2.0.0, status=sent (250 2.0.0 <box@domain.com> Saved)`,
+			`Nov 22 03:47:13 mx postfix/smtp[9078]: D549FB08A08B: to=<box@other.com>, relay=mx.other.com[1.2.3.4]:25, conn_use=2, delay=0.5, delays=0.1/0/0.2/0.2, dsn=5.1.1, status=bounced (host mx.other.com[1.2.3.4] said: 550 5.1.1 User unknown (in reply to RCPT TO command))`,
+			`Nov 22 03:47:04 mx postfix/qmgr[8015]: D549FB08A08B: from=<cvetkova09055@mail.ru>, size=1755, nrcpt=1 (queue active)`,
+		}
+	)
+
+	for i, l := range m {
+		r := getRecipient(l)
+
+		if i == 4 {
+			if r != nil {
+				t.Errorf("Expected nil value, but got %v", r)
+			}
+
+			continue
+		}
+
+		if r == nil {
+			t.Errorf("Expected recipient at %d, but got nil", i)
+			continue
+		}
+
+		switch i {
+		case 0:
+			if r.Address != "order@arobor.ru" || r.Relay != "none" || r.Dsn != "4.4.1" || r.Status != StatusDeferred {
+				t.Errorf("Unexpected recipient value %v", r)
+			}
+
+			if r.Delay != 307136 {
+				t.Errorf("Expected delay 307136, but got %f", r.Delay)
+			}
+
+		case 1:
+			if r.Address != "sinovv@domain.com" || r.Relay != "dovecot" || r.Status != StatusSent {
+				t.Errorf("Unexpected recipient value %v", r)
+			}
+
+		case 2:
+			if r.Address != "box@domain.com" || r.OrigTo != "alias@domain.com" || r.Status != StatusSent {
+				t.Errorf("Unexpected recipient value %v", r)
+			}
+
+			if r.Delay != 0.05 {
+				t.Errorf("Expected delay 0.05, but got %f", r.Delay)
+			}
+
+		case 3:
+			if r.Relay != "mx.other.com[1.2.3.4]:25" || r.Dsn != "5.1.1" || r.Status != StatusBounced {
+				t.Errorf("Unexpected recipient value %v", r)
+			}
+		}
+	}
+}
+
+func TestMailThreadRecipientsStatus(t *testing.T) {
+	var (
+		m = []string{
+			`Dec 27 02:38:54 mx postfix/qmgr[22753]: C93CEB08A046: from=<ina@somedomain.com>, size=1844, nrcpt=2 (queue active)`,
+			`Dec 27 02:39:24 mx postfix/smtp[15816]: C93CEB08A046: to=<order@arobor.ru>, relay=none, delay=307136, delays=307106/0.02/30/0, dsn=4.4.1, status=deferred (connect to arobor.ru[178.210.73.19]:25: Connection timed out)`,
+			`Dec 27 02:39:24 mx postfix/smtp[15816]: C93CEB08A046: to=<info@other.ru>, relay=mx.other.ru[1.2.3.4]:25, delay=307136, delays=307106/0.02/30/0, dsn=2.0.0, status=sent (250 Ok)`,
+			`Dec 27 03:49:24 mx postfix/smtp[15816]: C93CEB08A046: to=<order@arobor.ru>, relay=none, delay=310736, delays=307106/0.02/30/0, dsn=4.4.1, status=deferred (connect to arobor.ru[178.210.73.19]:25: Connection timed out)`,
+			`Dec 28 13:39:28 mx postfix/qmgr[22753]: C93CEB08A046: from=<ina@somedomain.com>, status=expired, returned to sender`,
+		}
+
+		s = NewStorage()
+	)
+
+	for _, l := range m {
+		h, err := NewMailThread(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		s.Set(h)
+	}
+
+	h := s.Get("C93CEB08A046")
+	if h == nil {
+		t.Fatalf("Expected mail thread, but got nil")
+	}
+
+	if v := h.GetTo(); v != "order@arobor.ru,info@other.ru" {
+		t.Errorf("Expected recipients order@arobor.ru,info@other.ru, but got %s", v)
+	}
+
+	for _, r := range h.GetRecipients() {
+		switch r.Address {
+		case "order@arobor.ru":
+			if r.Status != StatusExpired {
+				t.Errorf("Expected status %s, but got %s", StatusExpired, r.Status)
+			}
+
+			if r.Delay != 310736 {
+				t.Errorf("Expected last delay 310736, but got %f", r.Delay)
+			}
+
+		case "info@other.ru":
+			if r.Status != StatusSent {
+				t.Errorf("Expected status %s, but got %s", StatusSent, r.Status)
+			}
+		}
+	}
+}
+
+func TestGetRspamd(t *testing.T) {
+	var m = []string{
+		`Oct 18 03:47:02 mx rspamd[1234]: <a1b2c3>; task; rspamd_task_write_log: id: <20261018.abc@foo.net>, qid: <4F3A2B1C>, ip: 1.2.3.4, from: <spam@foo.net>, (default: F (reject): [15.20/15.00] [BAYES_SPAM(5.10){99.00%;},R_SPF_FAIL(1.00){-all;},MISSING_DATE(1.00){}]), len: 2345, time: 120.5ms, dns req: 12, digest: <0a1b2c>, rcpts: <a@some.net>,<b@some.net>, mime_rcpts: <a@some.net>`,
+		`Oct 18 03:47:02 mx rspamd[1234]: <a1b2c3>; task; rspamd_task_write_log: mid: <20261018.def@foo.net>, qid: <5A6B7C8D>, ip: 1.2.3.4, from: <spam@foo.net>, (default: T (add header): [7.20/15.00] [BAYES_SPAM(5.10){99.00%;},R_DKIM_REJECT(1.00){foo.net;}]), len: 2345, time: 120.5ms`,
+		`Oct 18 03:47:02 mx rspamd[1234]: <a1b2c3>; task; rspamd_task_write_log: id: <undef>, qid: <undef>, ip: 1.2.3.4, from: <good@foo.net>, (default: F (no action): [-0.50/15.00] [R_SPF_ALLOW(-0.20){+ip4:1.2.3.4;},DMARC_POLICY_ALLOW(-0.50){foo.net;reject;}]), len: 2345, time: 120.5ms`,
+		`Oct 18 03:47:02 mx rspamd[1234]: <a1b2c3>; task; rspamd_worker_check_finished: finished scan`,
+	}
+
+	for i, l := range m {
+		s, err := NewSpam(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		if i == 3 {
+			if s != nil {
+				t.Errorf("Expected nil value, but got %v", s)
+			}
+
+			continue
+		}
+
+		if s == nil {
+			t.Errorf("Expected Spam object at %d, but got nil", i)
+			continue
+		}
+
+		switch i {
+		case 0:
+			if s.Action != "reject" || s.Hits != 15.2 || s.Required != 15 {
+				t.Errorf("Unexpected verdict %s %f/%f", s.Action, s.Hits, s.Required)
+			}
+
+			if s.MsgId != "20261018.abc@foo.net" || s.QueueId != "4F3A2B1C" {
+				t.Errorf("Unexpected identity %s %s", s.MsgId, s.QueueId)
+			}
+
+			if len(s.Rules) != 3 || s.Rules[0] != "BAYES_SPAM" || s.Rules[2] != "MISSING_DATE" {
+				t.Errorf("Unexpected rules %v", s.Rules)
+			}
+
+			if s.Score != 2 {
+				t.Errorf("Expected score %d, but got %d", 2, s.Score)
+			}
+
+		case 1:
+			if s.Action != "add header" || s.MsgId != "20261018.def@foo.net" || s.QueueId != "5A6B7C8D" {
+				t.Errorf("Unexpected verdict %v", s)
+			}
+
+			if s.Score != 1 {
+				t.Errorf("Expected score %d, but got %d", 1, s.Score)
+			}
+
+		case 2:
+			if s.Score != 0 || s.Hits != -0.5 {
+				t.Errorf("Expected score 0 and hits -0.5, but got %d and %f", s.Score, s.Hits)
+			}
+
+			if s.MsgId != "" || s.QueueId != "" {
+				t.Errorf("Expected empty identity, but got %s %s", s.MsgId, s.QueueId)
+			}
+		}
+	}
+}
+
+func TestSetSpamStatRspamdQueueId(t *testing.T) {
+	var (
+		m = []string{
+			`Oct 18 03:47:01 mx postfix/smtpd[9032]: 4F3A2B1C: client=unknown[1.2.3.4]`,
+			`Oct 18 03:47:01 mx postfix/cleanup[9076]: 4F3A2B1C: message-id=<>`,
+		}
+
+		s = NewStorage()
+	)
+
+	for _, l := range m {
+		h, err := NewMailThread(l)
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err.Error())
+		}
+
+		s.Set(h)
+	}
+
+	sp, err := NewSpam(`Oct 18 03:47:02 mx rspamd[1234]: <a1b2c3>; task; rspamd_task_write_log: id: <undef>, qid: <4F3A2B1C>, ip: 1.2.3.4, from: <spam@foo.net>, (default: F (reject): [15.20/15.00] [BAYES_SPAM(5.10){99.00%;}]), len: 2345, time: 120.5ms, rcpts: <a@some.net>`)
+	if err != nil || sp == nil {
+		t.Fatalf("Expected Spam object, but got error %v", err)
+	}
+
+	if err = s.SetSpamStat(sp); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if v := s.Get("4F3A2B1C").GetSpamScore(); v != 1 {
+		t.Errorf("Expected spam score 1, but got %d", v)
+	}
+}
+
+func TestGetSpamdScore(t *testing.T) {
+	var m = []string{
+		`Nov 22 08:57:02 mx spamd[1800]: spamd: result: . -20 - SHORTCIRCUIT,USER_IN_WHITELIST scantime=0.0,size=982,user=spamd,uid=1003,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=41857,mid=<56515923.8060206@somed.foo>,autolearn=disabled,shortcircuit=ham`,
+		`Nov 22 09:25:37 mx spamd[1279]: spamd: result: Y 25 - HTML_IMAGE_ONLY_24,HTML_MESSAGE,RCVD_IN_BRBL_LASTEXT,SPF_SOFTFAIL,URIBL_BLACK scantime=0.7,size=4334,user=spamd,uid=1003,required_score=6.5,rhost=localhost,raddr=127.0.0.1,rport=42431,mid=<OTkyNjkxMgAC2616215Y266BAMTQ0ODE3MTExMzE2MDM1@ww2.chilelinks.cl>,autolearn=disabled,shortcircuit=no`,
+	}
+
+	for i, l := range m {
+		s, err := getSpamd(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		switch i {
+		case 0:
+			if s.Hits != -20 || s.Required != 5 {
+				t.Errorf("Expected score -20/5, but got %f/%f", s.Hits, s.Required)
+			}
+
+			if len(s.Rules) != 2 || s.Rules[1] != "USER_IN_WHITELIST" {
+				t.Errorf("Unexpected rules %v", s.Rules)
+			}
+
+		case 1:
+			if s.Hits != 25 || s.Required != 6.5 {
+				t.Errorf("Expected score 25/6.5, but got %f/%f", s.Hits, s.Required)
+			}
+
+			if len(s.Rules) != 5 || s.Rules[0] != "HTML_IMAGE_ONLY_24" {
+				t.Errorf("Unexpected rules %v", s.Rules)
+			}
+		}
+	}
+}
+
+func TestGetAmavisScore(t *testing.T) {
+	var m = []string{
+		`Dec  2 16:53:57 mx amavis[30290]: (30290-03) Passed SPAMMY {RelayedTaggedInbound}, [1.1.111.11]:49199 [1.1.111.11] <dashapopovich@yahoo.com> -> <ko@foo.net>, Queue-ID: 33F124562005, Message-ID: <4FB5F6D3A87C5EFD21246DD33739E940@ip-7-77-51-20.bb.netby.net>, mail_id: Tq0EZ1qm6_xb, Hits: 12.525, size: 34901, queued_as: E27B04562007, Tests: [BAYES_99=3.5,RCVD_IN_PBL=3.335,URIBL_BLACK=1.7], 667 ms`,
+		`Sep  5 11:21:07 mx amavis[18886]: (18886-11) Blocked BANNED (.asc,credit_card_receipt_D0CDD328.js) {DiscardedInbound,Quarantined}, [188.174.71.22]:59058 [188.174.71.22] <Blevins.9952@idotconnect.net> -> <gooduser@mailserver.net>, quarantine: banned@mailserver.net, Queue-ID: 26866B08A06B, Message-ID: <99564dd4f5dd96bf9dc7541eea5b75ba@,ailserver.net, mail_id: 7Vg0b3luDu2U, Hits: -, size: 16447, 181 ms`,
+	}
+
+	for i, l := range m {
+		s, err := getAmavisd(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		switch i {
+		case 0:
+			if s.Hits != 12.525 {
+				t.Errorf("Expected hits 12.525, but got %f", s.Hits)
+			}
+
+			if len(s.Rules) != 3 || s.Rules[1] != "RCVD_IN_PBL" {
+				t.Errorf("Unexpected rules %v", s.Rules)
+			}
+
+		case 1:
+			if s.Hits != 0 || len(s.Rules) != 0 {
+				t.Errorf("Expected empty score, but got %f %v", s.Hits, s.Rules)
+			}
+		}
+	}
+}
+
+func TestMailThreadSpamVerdict(t *testing.T) {
+	var (
+		parent = &MailThread{Id: "A"}
+		child  = &MailThread{Id: "B"}
+	)
+
+	child.setSpam(&Spam{Score: 2, Hits: 8.5, Required: 5, Rules: []string{"A", "B"}})
+	child.setSpam(&Spam{Score: 0, Hits: 3, Required: 15, Rules: []string{"B", "C"}})
+
+	if child.GetSpamScore() != 2 || child.GetSpamHits() != 8.5 || child.GetSpamRequired() != 5 {
+		t.Errorf("Unexpected verdict %d %f/%f", child.GetSpamScore(), child.GetSpamHits(), child.GetSpamRequired())
+	}
+
+	parent.setSpam(&Spam{Score: 0, Hits: -1, Rules: []string{"D"}})
+	parent.mergeSpam(child)
+
+	if parent.GetSpamScore() != 2 || parent.GetSpamHits() != 8.5 {
+		t.Errorf("Unexpected merged verdict %d %f", parent.GetSpamScore(), parent.GetSpamHits())
+	}
+
+	if v := parent.GetSpamRules(); v != "D,A,B,C" {
+		t.Errorf("Expected rules D,A,B,C, but got %s", v)
+	}
+}
+
+func TestGetAmavisCategories(t *testing.T) {
+	var m = []string{
+		`Oct 18 10:00:01 mx amavis[2112]: (02112-01) Blocked INFECTED (Eicar-Signature) {DiscardedInbound,Quarantined}, [1.2.3.4]:4321 [1.2.3.4] <virus@foo.net> -> <a@some.net>, quarantine: virus-7Vg0b3luDu2U, Queue-ID: 26866B08A06B, Message-ID: <eicar@foo.net>, mail_id: 7Vg0b3luDu2U, Hits: -, size: 1447, 181 ms`,
+		`Oct 18 10:00:02 mx amavis[2112]: (02112-02) Passed BAD-HEADER-0 {RelayedInbound,Quarantined}, [1.2.3.4]:4321 [1.2.3.4] <> -> <a@some.net>, Queue-ID: 36866B08A06B, Message-ID: <bh@foo.net>, mail_id: 8Vg0b3luDu2U, Hits: 2.1, size: 1447, queued_as: 46866B08A06B, 181 ms`,
+		`Oct 18 10:00:03 mx amavis[2112]: (02112-03) Passed UNCHECKED-ENCRYPTED {RelayedTagged}, [1.2.3.4]:4321 [1.2.3.4] <a@foo.net> -> <a@some.net>,<b@some.net>, Queue-ID: 56866B08A06B, Message-ID: <enc@foo.net>, mail_id: 9Vg0b3luDu2U, Hits: 0.1, size: 1447, queued_as: 66866B08A06B, 181 ms`,
+		`Oct 18 10:00:04 mx amavis[2112]: (02112-04) Blocked SPAM {DiscardedInbound}, [1.2.3.4]:4321 [1.2.3.4] <a@foo.net> -> <a@some.net>,<b@some.net>, Queue-ID: 76866B08A06B, Message-ID: <spam@foo.net>, mail_id: 0Vg0b3luDu2U, Hits: 25.1, size: 1447, 181 ms`,
+	}
+
+	for i, l := range m {
+		s, err := getAmavisd(l)
+
+		if err != nil || s == nil {
+			t.Errorf("Expected Spam object at %d, but got error %v", i, err)
+			continue
+		}
+
+		switch i {
+		case 0:
+			if s.Category != CategoryVirus || s.Action != ActionBlocked {
+				t.Errorf("Unexpected category %s and action %s", s.Category, s.Action)
+			}
+
+			if len(s.ActionTags) != 2 || s.ActionTags[0] != "DiscardedInbound" {
+				t.Errorf("Unexpected action tags %v", s.ActionTags)
+			}
+
+			if s.Score != 0 {
+				t.Errorf("Expected score 0, but got %d", s.Score)
+			}
+
+		case 1:
+			if s.Category != CategoryBadHeader || s.Action != ActionPassed {
+				t.Errorf("Unexpected category %s and action %s", s.Category, s.Action)
+			}
+
+			if s.QueuedAs != "46866B08A06B" {
+				t.Errorf("Expected queued_as 46866B08A06B, but got %s", s.QueuedAs)
+			}
+
+		case 2:
+			if s.Category != CategoryUncheckedEncrypted || s.ActionTags[0] != "RelayedTagged" {
+				t.Errorf("Unexpected category %s and tags %v", s.Category, s.ActionTags)
+			}
+
+		case 3:
+			if s.Category != CategorySpam || s.Action != ActionBlocked || s.Score != 2 {
+				t.Errorf("Unexpected verdict %v", s)
+			}
+		}
+	}
+}
+
+func TestSetSpamCategories(t *testing.T) {
+	var l = `Oct 18 10:00:01 mx amavis[2112]: (02112-01) Blocked INFECTED (Eicar-Signature) {DiscardedInbound,Quarantined}, [1.2.3.4]:4321 [1.2.3.4] <virus@foo.net> -> <a@some.net>,<b@some.net>, quarantine: virus-7Vg0b3luDu2U, Queue-ID: 26866B08A06B, Message-ID: <eicar@foo.net>, mail_id: 7Vg0b3luDu2U, Hits: -, size: 1447, 181 ms`
+
+	defer SetSpamCategories([]string{CategorySpam, CategorySpammy, CategoryBanned})
+
+	SetSpamCategories([]string{" spam", "infected "})
+
+	if !IsSpamCategory(CategoryVirus) || IsSpamCategory(CategoryBanned) {
+		t.Errorf("Unexpected spam categories %v", spamCategories)
+	}
+
+	s, err := getAmavisd(l)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Score != 2 {
+		t.Errorf("Expected score 2, but got %d", s.Score)
+	}
+}
+
+func TestGetVirus(t *testing.T) {
+	var m = []string{
+		`Oct 18 10:00:01 mx amavis[2112]: (02112-01) Blocked INFECTED (Eicar-Signature,Win.Test.EICAR_HDB-1) {DiscardedInbound,Quarantined}, [1.2.3.4]:4321 [1.2.3.4] <virus@foo.net> -> <a@some.net>, quarantine: virus-7Vg0b3luDu2U, Queue-ID: 26866B08A06B, Message-ID: <eicar@foo.net>, mail_id: 7Vg0b3luDu2U, Hits: -, size: 1447, 181 ms`,
+		`Oct 18 10:00:02 mx clamav-milter[1234]: Message 4F3A2B1C from <virus@foo.net> to <a@some.net> with subject 'test' message-id '<eicar@foo.net>' date 'Sun, 18 Oct 2026 10:00:00 +0000' infected by Eicar-Signature`,
+		`Oct 18 10:00:03 mx clamav-milter[1234]: Message 5F3A2B1C infected by Win.Test.EICAR_HDB-1`,
+		`Oct 18 10:00:04 mx clamd[987]: instream(127.0.0.1@54321): Eicar-Signature FOUND`,
+	}
+
+	for i, l := range m {
+		s, err := NewSpam(l)
+
+		if err != nil || s == nil {
+			t.Errorf("Expected Spam object at %d, but got error %v", i, err)
+			continue
+		}
+
+		switch i {
+		case 0:
+			if len(s.Viruses) != 2 || s.Viruses[1] != "Win.Test.EICAR_HDB-1" || s.Scanner != "amavis" {
+				t.Errorf("Unexpected viruses %v from %s", s.Viruses, s.Scanner)
+			}
+
+		case 1:
+			if s.QueueId != "4F3A2B1C" || s.MsgId != "eicar@foo.net" || s.Scanner != "clamav-milter" {
+				t.Errorf("Unexpected verdict %v", s)
+			}
+
+			if len(s.Viruses) != 1 || s.Viruses[0] != "Eicar-Signature" {
+				t.Errorf("Unexpected viruses %v", s.Viruses)
+			}
+
+		case 2:
+			if s.QueueId != "5F3A2B1C" || s.MsgId != "" || s.Viruses[0] != "Win.Test.EICAR_HDB-1" {
+				t.Errorf("Unexpected verdict %v", s)
+			}
+
+		case 3:
+			if s.HasId() || s.Scanner != "clamd" || s.Viruses[0] != "Eicar-Signature" {
+				t.Errorf("Unexpected verdict %v", s)
+			}
+		}
+	}
+}
+
+func TestGetSasl(t *testing.T) {
+	var m = []string{
+		`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[01.01.001.01], sasl_method=PLAIN, sasl_username=abcd@somedomain.com`,
+		`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[01.01.001.01], sasl_method=CRAM-MD5, sasl_username=abcd, sasl_sender=abcd@somedomain.com`,
+		`Nov 22 01:45:57 mx postfix/smtpd[5910]: A2CAFB08A049: client=unknown[1.1.1.1]`,
+	}
+
+	for i, l := range m {
+		h, err := NewMailThread(l)
+
+		if err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+			continue
+		}
+
+		switch i {
+		case 0:
+			if h.SaslMethod != "PLAIN" || h.GetSaslUser() != "abcd@somedomain.com" {
+				t.Errorf("Unexpected sasl values %s %s", h.SaslMethod, h.GetSaslUser())
+			}
+
+		case 1:
+			if h.SaslMethod != "CRAM-MD5" || h.GetSaslUser() != "abcd" {
+				t.Errorf("Unexpected sasl values %s %s", h.SaslMethod, h.GetSaslUser())
+			}
+
+		case 2:
+			if h.SaslMethod != "" || h.GetSaslUser() != "" {
+				t.Errorf("Expected empty sasl values, but got %s %s", h.SaslMethod, h.GetSaslUser())
+			}
+		}
+	}
+}
+
+func TestSaslDetector(t *testing.T) {
+	var (
+		d  = NewSaslDetector(time.Hour, 3, 0)
+		at = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+		c  int
+	)
+
+	for i := 0; i < 6; i++ {
+		m := &MailThread{
+			Id:        "A",
+			SaslUser:  "abcd@somedomain.com",
+			SpamScore: 1,
+			Client: &Client{
+				At: at.Add(time.Duration(i) * 20 * time.Minute),
+			},
+		}
+
+		if v := d.Check(m); v != nil {
+			if v.Spam != 3 {
+				t.Errorf("Expected spam count 3, but got %d", v.Spam)
+			}
+
+			c++
+		}
+	}
+
+	// Flagged at 40 and 100 minutes
+	if c != 2 {
+		t.Errorf("Expected user flagged twice, but got %d", c)
+	}
+
+	d = NewSaslDetector(time.Hour, 0, 10)
+
+	m := &MailThread{
+		Id:         "B",
+		SaslUser:   "efgh@somedomain.com",
+		Recipients: make([]*Recipient, 12),
+		Client: &Client{
+			At: at,
+		},
+	}
+
+	if v := d.Check(m); v == nil || v.Recipients != 12 {
+		t.Errorf("Expected user flagged on recipients count, but got %v", v)
+	}
+
+	if v := d.Check(&MailThread{Id: "C"}); v != nil {
+		t.Errorf("Expected nil value for anonymous client, but got %v", v)
+	}
+
+	// Idle user is removed after window
+	d.Check(&MailThread{Id: "D", SaslUser: "ijkl@somedomain.com", Client: &Client{At: at.Add(2 * time.Hour)}})
+
+	if _, ok := d.users["efgh@somedomain.com"]; ok || len(d.users) != 1 {
+		t.Errorf("Expected idle user removed, but got %d users", len(d.users))
+	}
+}
+
+func TestParserRegistry(t *testing.T) {
+	var (
+		line = `Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99,HTML_MESSAGE scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`
+		site = `Nov 22 02:25:04 mx site-filter: ok`
+		v    interface{}
+		err  error
+	)
+
+	for _, n := range []string{"postfix", "reject", "spamd", "amavis", "rspamd", "clamav-milter", "clamd"} {
+		if !HasParser(n) {
+			t.Errorf("Expected parser %s is registered", n)
+		}
+	}
+
+	if v, err = Parse(line); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if sp, ok := v.(*Spam); !ok || sp.Scanner != "spamd" {
+		t.Errorf("Expected spamd verdict, but got %v", v)
+	}
+
+	if err = EnableParser("spamd", false); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if _, err = Parse(line); err != ErrorStrFormatNotSupported {
+		t.Errorf("Expected disabled parser, but got %v", err)
+	}
+
+	EnableParser("spamd", true)
+
+	if err = EnableParser("unknown", false); err != ErrorUnknownParser {
+		t.Errorf("Expected ErrorUnknownParser, but got %v", err)
+	}
+
+	err = RegisterParser(NewParser("site-filter", func(str string) (interface{}, error) {
+		if !strings.Contains(str, " site-filter: ") {
+			return nil, ErrorStrFormatNotSupported
+		}
+
+		return &Spam{MsgId: "site@localhost", Score: 1, Scanner: "site-filter"}, nil
+	}))
+
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if err = RegisterParser(NewParser("site-filter", nil)); err != ErrorParserExists {
+		t.Errorf("Expected ErrorParserExists, but got %v", err)
+	}
+
+	if v, err = Parse(site); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if sp, ok := v.(*Spam); !ok || sp.Scanner != "site-filter" {
+		t.Errorf("Expected site-filter verdict, but got %v", v)
+	}
+
+	EnableParser("site-filter", false)
+}
+
+func TestStorageParse(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[01.01.001.01]`,
+			`Nov 22 02:24:53 mx postfix/cleanup[6224]: B29AFB08A08A: message-id=<abcd@localhost>`,
+			`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:04 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+		}
+		done *MailThread
+	)
+
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = v.(*MailThread)
+
+		return nil
+	})
+
+	for _, l := range m {
+		if _, err := s.Parse(l); err != nil {
+			t.Fatalf("Unexpected error %s on %s", err.Error(), l)
+		}
+	}
+
+	if done == nil || done.GetSpamScore() != 1 {
+		t.Fatalf("Expected spam thread is done, but got %v", done)
+	}
+
+	if _, err := s.Parse(`Nov 22 02:25:04 mx kernel: eth0 up`); err != ErrorStrFormatNotSupported {
+		t.Errorf("Expected ErrorStrFormatNotSupported, but got %v", err)
+	}
+}
+
+func TestRule(t *testing.T) {
+	var (
+		r   *Rule
+		v   interface{}
+		err error
+	)
+
+	for _, e := range []string{
+		`site-filter\[\d+\]: (?P<score>\d+)`,
+		`site-filter\[\d+\]: (?P<queue_id>\w+) (?P<unknown>\w+)`,
+		`site-filter\[\d+\]: (?P<queue_id>\w+`,
+		`site-filter\[\d+\]: (?P<queue_id>\w+) from=(?P<from>\S+)`,
+	} {
+		if _, err = NewRule("rule.site", "", e); err == nil {
+			t.Errorf("Expected error on rule %s", e)
+		}
+	}
+
+	if _, err = NewRule("rule.site", "unknown", `(?P<queue_id>\w+)`); err == nil {
+		t.Errorf("Expected error on unknown rule kind")
+	}
+
+	if _, err = NewRule("rule.site", RuleThread, `(?P<message_id>\w+)`); err == nil {
+		t.Errorf("Expected error on thread rule without queue_id")
+	}
+
+	if _, err = NewRule("rule.site", RuleThread, `(?P<queue_id>\w+) (?P<score>\d+)`); err == nil || !strings.Contains(err.Error(), "not used by thread rules") {
+		t.Errorf("Expected error on unused capture group, but got %v", err)
+	}
+
+	r, err = NewRule("rule.site", "", `site-filter\[\d+\]: (?P<queue_id>[0-9A-F]+): (?P<category>\w+) hits=(?P<hits>[\d\.]+)/(?P<required>[\d\.]+)(?: virus=(?P<virus>\S+))?`)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if _, err = r.Parse(`Nov 22 02:25:04 mx kernel: eth0 up`); err != ErrorStrFormatNotSupported {
+		t.Errorf("Expected ErrorStrFormatNotSupported, but got %v", err)
+	}
+
+	if v, err = r.Parse(`Nov 22 02:25:04 mx site-filter[123]: B29AFB08A08A: clean hits=7.5/5.0 virus=Eicar-Test-Signature`); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	sp, ok := v.(*Spam)
+	if !ok {
+		t.Fatalf("Expected spam verdict, but got %v", v)
+	}
+
+	if sp.QueueId != "B29AFB08A08A" || sp.Category != "CLEAN" || sp.Score != 1 ||
+		sp.Hits != 7.5 || sp.Required != 5 || sp.Scanner != "rule.site" ||
+		len(sp.Viruses) != 1 || sp.Viruses[0] != "Eicar-Test-Signature" {
+		t.Errorf("Unexpected spam values %v", sp)
+	}
+
+	r, err = NewRule("rule.gate", RuleThread, `gate\[\d+\]: (?P<queue_id>[0-9A-Za-z]+): mid=<(?P<message_id>[^>]+)>`)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	// Long queue id is mixed case
+	if v, err = r.Parse(`Nov 22 02:25:04 mx gate[12]: 4bQ3xC5KzRz9s: mid=<abcd@localhost>`); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if m, ok := v.(*MailThread); !ok || m.Id != "4BQ3XC5KZRZ9S" || m.MsgId != "abcd@localhost" || m.seen.IsZero() || m.GetTime().IsZero() {
+		t.Errorf("Expected mail thread, but got %v", v)
+	}
+
+	// Postfix client replaces the rule client
+	m := v.(*MailThread)
+	m.apply(&MailThread{Id: m.Id, Client: &Client{IP: "1.1.1.1"}})
+
+	if m.GetFromIp() != "1.1.1.1" {
+		t.Errorf("Expected client 1.1.1.1, but got %s", m.GetFromIp())
+	}
+}
+
+func TestPostfixInstance(t *testing.T) {
+	var m = []string{
+		`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+		`Nov 22 02:24:53 mx postfix-out/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+		`Nov 22 02:24:53 mx postfix/submission/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1], sasl_method=PLAIN, sasl_username=abcd`,
+		`Nov 22 02:24:53 mx mta-in/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+		`Nov 22 02:24:53 mx dovecot/imap[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+	}
+
+	defer SetSyslogNames([]string{"postfix", "postfix-*", "postfix/*"})
+
+	for i, l := range m {
+		h, err := NewMailThread(l)
+
+		switch i {
+		case 0, 1, 2:
+			if err != nil {
+				t.Errorf("Unexpected error %s on %s", err.Error(), l)
+				continue
+			}
+
+			if v := []string{"postfix", "postfix-out", "postfix/submission"}[i]; h.GetInstance() != v {
+				t.Errorf("Expected instance %s, but got %s", v, h.GetInstance())
+			}
+
+			if h.Client == nil || h.Client.IP != "1.1.1.1" {
+				t.Errorf("Expected client 1.1.1.1, but got %v", h.Client)
+			}
+
+		case 3, 4:
+			if err != ErrorStrFormatNotSupported {
+				t.Errorf("Expected ErrorStrFormatNotSupported on %s, but got %v", l, err)
+			}
+		}
+	}
+
+	SetSyslogNames([]string{"postfix", " mta-* "})
+
+	if h, err := NewMailThread(m[3]); err != nil || h.GetInstance() != "mta-in" {
+		t.Errorf("Expected instance mta-in, but got %v, %v", h, err)
+	}
+
+	if IsSyslogName("postfix-out") {
+		t.Errorf("Expected postfix-out is not postfix instance")
+	}
+}
+
+func TestStorageInstances(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+			`Nov 22 02:24:53 mx postfix-out/smtpd[6224]: B29AFB08A08A: client=unknown[2.2.2.2]`,
+			`Nov 22 02:24:55 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+		}
+		done []*MailThread
+	)
+
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+
+	for _, l := range m[:2] {
+		s.Parse(l)
+	}
+
+	if s.Len() != 2 || s.Get("postfix-out/B29AFB08A08A").GetFromIp() != "2.2.2.2" {
+		t.Fatalf("Expected thread per instance, but got %d", s.Len())
+	}
+
+	// Content filter does not log the instance
+	if err := s.Emit(&Spam{QueueId: "B29AFB08A08A", Score: 1}); err != ErrorAmbiguousSpamItem {
+		t.Errorf("Expected ErrorAmbiguousSpamItem, but got %v", err)
+	}
+
+	s.Parse(m[2])
+
+	if len(done) != 1 || done[0].GetInstance() != "postfix" || done[0].GetFromIp() != "1.1.1.1" {
+		t.Fatalf("Expected thread of postfix instance completed, but got %v", done)
+	}
+
+	// Line without instance belongs to the only thread
+	s.Emit(&MailThread{Id: "B29AFB08A08A", MsgId: "abcd@localhost"})
+	s.Emit(&Spam{QueueId: "B29AFB08A08A", Score: 1})
+
+	if v := s.Get("B29AFB08A08A"); s.Len() != 1 || v.GetInstance() != "postfix-out" || v.MsgId != "abcd@localhost" || v.GetSpamScore() != 1 {
+		t.Errorf("Expected line merged to postfix-out thread, but got %v", v)
+	}
+}
+
+func TestNewScreenEvent(t *testing.T) {
+	var m = []string{
+		`Nov 22 02:24:53 mx postfix/postscreen[6223]: CONNECT from [1.2.3.4]:5555 to [5.6.7.8]:25`,
+		`Nov 22 02:24:53 mx postfix/dnsblog[6224]: addr 1.2.3.4 listed by domain zen.spamhaus.org as 127.0.0.4`,
+		`Nov 22 02:24:53 mx postfix/postscreen[6223]: PREGREET 11 after 0.1 from [1.2.3.4]:5555: EHLO bot\r\n`,
+		`Nov 22 02:24:53 mx postfix/postscreen[6223]: DNSBL rank 5 for [1.2.3.4]:5555`,
+		`Nov 22 02:24:54 mx postfix/postscreen[6223]: NOQUEUE: reject: RCPT from [1.2.3.4]:5555: 550 5.7.1 Service unavailable; client [1.2.3.4] blocked using zen.spamhaus.org; from=<a@bot.net>, to=<b@some.net>, proto=ESMTP, helo=<bot>`,
+		`Nov 22 02:24:55 mx postfix/postscreen[6223]: HANGUP after 0.5 from [1.2.3.4]:5555 in tests after SMTP handshake`,
+		`Nov 22 02:24:55 mx postfix/postscreen[6223]: DISCONNECT [1.2.3.4]:5555`,
+		`Nov 22 02:24:56 mx postfix-in/postscreen[6225]: PASS NEW [2001:db8::1]:4444`,
+		`Nov 22 02:24:56 mx postfix/postscreen[6225]: cache btree:/var/lib/postfix/postscreen_cache full cleanup: retained=1 dropped=0 entries`,
+		`Nov 22 02:24:56 mx dovecot/postscreen[6225]: PASS NEW [1.2.3.4]:4444`,
+	}
+
+	for i, l := range m {
+		e, err := NewScreenEvent(l)
+
+		if i >= 8 {
+			if err != ErrorStrFormatNotSupported {
+				t.Errorf("Expected ErrorStrFormatNotSupported on %s, but got %v", l, err)
+			}
+
+			continue
+		}
+
+		if err != nil {
+			t.Errorf("Unexpected error %s on %s", err.Error(), l)
+			continue
+		}
+
+		if v := []string{"1.2.3.4", "2001:db8::1"}[i/7]; e.Client.GetIp() != v {
+			t.Errorf("Expected client %s, but got %s", v, e.Client.GetIp())
+		}
+
+		if v := []string{
+			ScreenConnect,
+			ScreenListed,
+			"PREGREET",
+			ScreenDnsbl,
+			ScreenReject,
+			"HANGUP",
+			ScreenDisconnect,
+			ScreenPassNew,
+		}[i]; e.Action != v {
+			t.Errorf("Expected action %s, but got %s", v, e.Action)
+		}
+
+		switch i {
+		case 1:
+			if e.Dnsbl != "zen.spamhaus.org" {
+				t.Errorf("Expected zen.spamhaus.org, but got %s", e.Dnsbl)
+			}
+
+		case 3:
+			if e.Rank != 5 {
+				t.Errorf("Expected rank 5, but got %d", e.Rank)
+			}
+
+		case 4:
+			if e.Reject == nil || e.Reject.To != "b@some.net" || e.Reject.Code != "550" || e.Reject.Proto != "ESMTP" {
+				t.Errorf("Unexpected reject %v", e.Reject)
+			}
+
+		case 7:
+			if e.Instance != "postfix-in" || !e.IsFinal() {
+				t.Errorf("Expected final event from postfix-in, but got %v", e)
+			}
+		}
+	}
+}
+
+func TestStorageShards(t *testing.T) {
+	var (
+		s    = NewStorage()
+		wg   sync.WaitGroup
+		stop = make(chan bool)
+	)
+
+	// Instances of the queue id share the shard
+	s.Set(&MailThread{Id: "B29AFB08A08A", Instance: "postfix-in"})
+	s.Set(&MailThread{Id: "B29AFB08A08A", Instance: "postfix-out"})
+
+	if n := s.data.count("B29AFB08A08A"); n != 2 {
+		t.Errorf("Expected 2 threads in the shard, but got %d", n)
+	}
+
+	// Threads are got without the storage lock while lines are applied
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				s.Get("A00FF")
+				s.Len()
+			}
+		}
+	}()
+
+	for i := 0; i < 1000; i++ {
+		s.Parse(fmt.Sprintf(`Nov 22 02:24:53 mx postfix/smtpd[6223]: A%04X: client=unknown[1.1.1.1]`, i))
+	}
+
+	for i := 0; i < 1000; i += 2 {
+		s.Parse(fmt.Sprintf(`Nov 22 02:24:55 mx postfix/qmgr[1234]: A%04X: removed`, i))
+	}
+
+	close(stop)
+	wg.Wait()
+
+	if n := s.Len(); n != 502 || s.Get("A00FF") == nil || s.Get("A00FE") != nil {
+		t.Errorf("Expected 502 threads, but got %d", n)
+	}
+}
+
+func TestStorageScreen(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/postscreen[6223]: CONNECT from [1.2.3.4]:5555 to [5.6.7.8]:25`,
+			`Nov 22 02:24:53 mx postfix/dnsblog[6224]: addr 1.2.3.4 listed by domain zen.spamhaus.org as 127.0.0.4`,
+			`Nov 22 02:24:53 mx postfix/postscreen[6223]: PREGREET 11 after 0.1 from [1.2.3.4]:5555: EHLO bot\r\n`,
+			`Nov 22 02:24:53 mx postfix/postscreen[6223]: DNSBL rank 5 for [1.2.3.4]:5555`,
+			`Nov 22 02:24:55 mx postfix/postscreen[6223]: HANGUP after 0.5 from [1.2.3.4]:5555 in tests after SMTP handshake`,
+			`Nov 22 02:24:55 mx postfix/postscreen[6223]: DISCONNECT [1.2.3.4]:5555`,
+			`Nov 22 02:24:56 mx postfix/postscreen[6225]: CONNECT from [5.5.5.5]:4444 to [5.6.7.8]:25`,
+			`Nov 22 02:24:56 mx postfix/postscreen[6225]: PASS OLD [5.5.5.5]:4444`,
+		}
+		done []*Screen
+	)
+
+	s.SetEventCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*Screen))
+
+		return nil
+	})
+
+	for i, l := range m {
+		if _, err := s.Parse(l); err != nil {
+			t.Fatalf("Unexpected error %s on %s", err.Error(), l)
+		}
+
+		if i == 3 {
+			if v := s.GetScreen("1.2.3.4"); v == nil || v.Rank != 5 {
+				t.Errorf("Expected pending connection, but got %v", v)
+			}
+		}
+	}
+
+	if len(done) != 2 {
+		t.Fatalf("Expected 2 connections, but got %d", len(done))
+	}
+
+	if v := done[0]; v.GetSpamScore() != 1 || v.GetSpamHits() != 5 ||
+		v.GetSpamRules() != "PREGREET,HANGUP,zen.spamhaus.org" || v.Result != ScreenDisconnect {
+		t.Errorf("Unexpected bot connection %v", v)
+	}
+
+	if v := done[1]; v.GetSpamScore() != 0 || v.Result != ScreenPassOld || v.GetFromIp() != "5.5.5.5" {
+		t.Errorf("Unexpected clean connection %v", v)
+	}
+
+	if v := s.GetScreen("1.2.3.4"); v != nil {
+		t.Errorf("Expected connection is removed, but got %v", v)
+	}
+
+	// Connection without final action is completed after window,
+	// DNSBL rank alone counts as spam
+	s.Parse(`Nov 22 02:25:00 mx postfix/postscreen[6227]: CONNECT from [6.6.6.6]:3333 to [5.6.7.8]:25`)
+	s.Parse(`Nov 22 02:25:00 mx postfix/postscreen[6227]: DNSBL rank 2 for [6.6.6.6]:3333`)
+	s.Parse(`Nov 22 02:40:00 mx postfix/postscreen[6228]: CONNECT from [7.7.7.7]:2222 to [5.6.7.8]:25`)
+
+	if len(done) != 3 || done[2].GetFromIp() != "6.6.6.6" || done[2].GetSpamScore() != 1 || len(s.screens) != 1 {
+		t.Errorf("Expected stale connection completed, but got %v", done)
+	}
+}
+
+func TestDeliveryAgents(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/pickup[6223]: 8E4C5B08A08A: uid=33 from=<www-data>`,
+			`Nov 22 02:24:53 mx postfix/cleanup[6224]: 8E4C5B08A08A: message-id=<20151122022453.8E4C5B08A08A@mx>`,
+			`Nov 22 02:24:53 mx postfix/qmgr[1234]: 8E4C5B08A08A: from=<www-data@mx.some.net>, size=512, nrcpt=3 (queue active)`,
+			`Nov 22 02:24:54 mx postfix/error[6225]: 8E4C5B08A08A: to=<a@some.net>, relay=none, delay=1, delays=0.5/0/0/0.5, dsn=4.4.1, status=deferred (delivery temporarily suspended)`,
+			`Nov 22 02:24:54 mx postfix/discard[6226]: 8E4C5B08A08A: to=<b@some.net>, relay=none, delay=1, delays=0.5/0/0/0.5, dsn=2.0.0, status=sent (discarded)`,
+			`Nov 22 02:24:54 mx postfix/virtual[6227]: 8E4C5B08A08A: to=<c@some.net>, relay=virtual, delay=1, delays=0.5/0/0/0.5, dsn=2.0.0, status=sent (delivered to maildir)`,
+			`Nov 22 02:24:55 mx postfix/postsuper[6228]: Deleted: 1 message`,
+			`Nov 22 02:24:55 mx postfix/postsuper[6228]: 8E4C5B08A08A: removed`,
+		}
+		done *MailThread
+	)
+
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = v.(*MailThread)
+
+		return nil
+	})
+
+	for _, l := range m {
+		if _, err := s.Parse(l); err != nil && err != ErrorStrFormatNotSupported {
+			t.Fatalf("Unexpected error %s on %s", err.Error(), l)
+		}
+	}
+
+	if done == nil {
+		t.Fatalf("Expected thread removed by postsuper is done")
+	}
+
+	if done.GetUid() != "33" || done.GetFrom() != "www-data@mx.some.net" {
+		t.Errorf("Unexpected pickup values uid %s, from %s", done.GetUid(), done.GetFrom())
+	}
+
+	if done.Client == nil || done.GetFromIp() != "127.0.0.1" || done.GetTime().IsZero() {
+		t.Errorf("Expected local client, but got %v", done.Client)
+	}
+
+	if len(done.Recipients) != 3 {
+		t.Fatalf("Expected 3 recipients, but got %d", len(done.Recipients))
+	}
+
+	for i, v := range []string{StatusDeferred, StatusSent, StatusSent} {
+		if done.Recipients[i].Status != v {
+			t.Errorf("Expected %s status, but got %s", v, done.Recipients[i].Status)
+		}
+	}
+
+	if _, err := getId(m[6]); err != ErrorStrFormatNotSupported {
+		t.Errorf("Expected postsuper summary is not thread, but got %v", err)
+	}
+}
+
+func TestBounceThread(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+			`Nov 22 02:24:53 mx postfix/cleanup[6224]: B29AFB08A08A: message-id=<abcd@localhost>`,
+			`Nov 22 02:24:53 mx postfix/qmgr[1234]: B29AFB08A08A: from=<forged@victim.net>, size=512, nrcpt=1 (queue active)`,
+			`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:05 mx postfix/local[6225]: B29AFB08A08A: to=<nobody@some.net>, relay=local, delay=1, delays=0.5/0/0/0.5, dsn=5.1.1, status=bounced (unknown user: "nobody")`,
+			`Nov 22 02:25:05 mx postfix/cleanup[6224]: C39AFB08A08B: message-id=<20151122022505.C39AFB08A08B@mx>`,
+			`Nov 22 02:25:05 mx postfix/bounce[6226]: B29AFB08A08A: sender non-delivery notification: C39AFB08A08B`,
+			`Nov 22 02:25:05 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+			`Nov 22 02:25:05 mx postfix/qmgr[1234]: C39AFB08A08B: from=<>, size=2512, nrcpt=1 (queue active)`,
+			`Nov 22 02:25:06 mx postfix/smtp[6227]: C39AFB08A08B: to=<forged@victim.net>, relay=mx.victim.net[2.2.2.2]:25, delay=1, delays=0.5/0/0/0.5, dsn=2.0.0, status=sent (250 Ok)`,
+			`Nov 22 02:25:06 mx postfix/qmgr[1234]: C39AFB08A08B: removed`,
+		}
+		done []*MailThread
+	)
+
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+
+	for i, l := range m {
+		if _, err := s.Parse(l); err != nil {
+			t.Fatalf("Unexpected error %s on %s", err.Error(), l)
+		}
+
+		if i == 6 {
+			if v := s.Get("C39AFB08A08B"); v == nil || v.GetBounceOf() != "B29AFB08A08A" || v.MsgId == "" {
+				t.Errorf("Expected notification linked to the thread, but got %v", v)
+			}
+		}
+	}
+
+	if len(done) != 2 {
+		t.Fatalf("Expected 2 threads, but got %d", len(done))
+	}
+
+	if v := done[0]; v.GetBounceId() != "C39AFB08A08B" || v.IsBackscatter() {
+		t.Errorf("Unexpected original thread %v", v)
+	}
+
+	if v := done[1]; v.GetBounceOf() != "B29AFB08A08A" || !v.IsBackscatter() ||
+		v.GetTo() != "forged@victim.net" || v.GetTime().IsZero() {
+		t.Errorf("Unexpected notification thread %v", v)
+	}
+
+	if c := s.GetCounters(); c.Threads != 2 || c.Bounces != 1 || c.Backscatter != 1 {
+		t.Errorf("Unexpected counters %v", c)
+	}
+}
+
+func TestSetSpamStatCorrelation(t *testing.T) {
+	var (
+		s = NewStorage()
+	)
+
+	// Campaign reuses message id
+	s.Set(&MailThread{Id: "A1", MsgId: "campaign@localhost"})
+	s.Set(&MailThread{Id: "A2", MsgId: "campaign@localhost"})
+	// Content filter round trip
+	s.Set(&MailThread{Id: "B1", MsgId: "single@localhost", childId: "B2"})
+	s.Set(&MailThread{Id: "B2", MsgId: "single@localhost"})
+	s.Get("B1").childId = "B2"
+	s.Set(s.Get("B1"))
+
+	if err := s.SetSpamStat(&Spam{MsgId: "campaign@localhost", QueueId: "a2", Score: 1}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Get("A2").GetSpamScore() != 1 || s.Get("A1").GetSpamScore() != 0 {
+		t.Errorf("Expected verdict on A2 thread")
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "campaign@localhost", QueueId: "A1", QueuedAs: "A3", Score: 1}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Get("A1").GetSpamScore() != 1 {
+		t.Errorf("Expected verdict on A1 thread")
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "campaign@localhost", Score: 1}); err != ErrorAmbiguousSpamItem {
+		t.Errorf("Expected ErrorAmbiguousSpamItem, but got %v", err)
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "campaign@localhost", QueueId: "A9", Score: 1}); err != ErrorAmbiguousSpamItem {
+		t.Errorf("Expected ErrorAmbiguousSpamItem, but got %v", err)
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "single@localhost", Score: 1}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Get("B1").GetSpamScore() != 1 || s.Get("B2").GetSpamScore() != 0 {
+		t.Errorf("Expected verdict on parent B1 thread")
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "single@localhost", QueueId: "B1", QueuedAs: "B2", Score: 1}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Get("B2").GetSpamScore() != 1 {
+		t.Errorf("Expected verdict on reinjected B2 thread")
+	}
+
+	// Amavis queue id is unknown, message id matches the only thread
+	s.Set(&MailThread{Id: "C1", MsgId: "amavis@localhost"})
+
+	if _, err := s.Parse(`Dec  1 09:59:32 mx amavis[27587]: (27587-19) Passed SPAM, LOCAL [10.10.1.2] [3.6.4.4] <a@some.ua> -> <b@foo.net>, Queue-ID: 0F1E2D3C4B5, Message-ID: <amavis@localhost>, mail_id: 4ubUIQY5JxVu, Hits: 11.004, size: 144953, 749 ms`); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if s.Get("C1").GetSpamScore() != 1 {
+		t.Errorf("Expected verdict on C1 thread by message id")
+	}
+
+	if err := s.SetSpamStat(&Spam{MsgId: "unknown@localhost", QueueId: "C9", Score: 1}); err != ErrorUnknownSpamItem {
+		t.Errorf("Expected ErrorUnknownSpamItem, but got %v", err)
+	}
+}
+
+func TestStorageIndexes(t *testing.T) {
+	var (
+		s = NewStorage()
+	)
+
+	s.Set(&MailThread{Id: "A1", Client: &Client{IP: "IPv6:2001:DB8::1"}})
+	s.Set(&MailThread{Id: "A1", MsgId: "abcd@localhost", childId: "A2"})
+	s.Set(&MailThread{Id: "A2", MsgId: "abcd@localhost", Client: &Client{IP: "127.0.0.1"}})
+	s.Set(&MailThread{Id: "A3", Client: &Client{IP: "2001:db8::1"}})
+
+	if v := s.GetByMessageId("abcd@localhost"); len(v) != 2 {
+		t.Errorf("Expected 2 threads by message id, but got %d", len(v))
+	}
+
+	if v := s.GetByIp("2001:db8:0::1"); len(v) != 2 {
+		t.Errorf("Expected 2 threads by client ip, but got %d", len(v))
+	}
+
+	if v := s.Get("A2"); v.parentId != "A1" {
+		t.Errorf("Expected child thread linked to A1, but got %s", v.parentId)
+	}
+
+	s.Destroy("A1")
+	s.Destroy("A3")
+
+	if v := s.GetByMessageId("abcd@localhost"); len(v) != 1 || v[0].Id != "A2" {
+		t.Errorf("Expected A2 thread by message id, but got %v", v)
+	}
+
+	if v := s.GetByIp("2001:db8::1"); len(v) != 0 {
+		t.Errorf("Expected empty client index, but got %v", v)
+	}
+
+	if len(s.msgIds) != 1 || len(s.clients) != 1 || len(s.parents) != 0 {
+		t.Errorf("Unexpected indexes %v %v %v", s.msgIds, s.clients, s.parents)
+	}
+}
+
+func benchmarkStorage(n int) *Storage {
+	s := NewStorage()
+
+	for i := 0; i < n; i++ {
+		id := strings.ToUpper(strconv.FormatInt(int64(i), 16))
+
+		s.Set(&MailThread{
+			Id:     id,
+			MsgId:  id + "@localhost",
+			Client: &Client{IP: "10.0.0." + strconv.Itoa(i%250)},
+		})
+	}
+
+	return s
+}
+
+func BenchmarkSetSpamStatMessageId(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		s := benchmarkStorage(n)
+		sp := &Spam{MsgId: strings.ToUpper(strconv.FormatInt(int64(n/2), 16)) + "@localhost", Score: 1}
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.SetSpamStat(sp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSetSpamStatQueueId(b *testing.B) {
+	for _, n := range []int{1000, 100000} {
+		s := benchmarkStorage(n)
+		sp := &Spam{QueueId: strconv.FormatInt(int64(n/2), 16), Score: 1}
+
+		b.Run(strconv.Itoa(n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				if err := s.SetSpamStat(sp); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkStorageSetDestroy(b *testing.B) {
+	s := benchmarkStorage(100000)
+
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		m := &MailThread{
+			Id:     "BENCH",
+			MsgId:  "bench@localhost",
+			Client: &Client{IP: "10.0.0.1"},
+		}
+
+		s.Set(m)
+		s.Destroy(m.Id)
+	}
+}
+
+func TestStorageExpire(t *testing.T) {
+	var (
+		s    = NewStorage()
+		at   = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+		done []*MailThread
+	)
+
+	s.SetTTL(time.Hour)
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+
+	s.Emit(&MailThread{Id: "A1", seen: at})
+	s.Emit(&MailThread{Id: "A2", seen: at.Add(30 * time.Minute)})
+	s.Emit(&MailThread{Id: "A1", seen: at.Add(40 * time.Minute)})
+	s.Emit(&MailThread{Id: "A3", seen: at.Add(90 * time.Minute)})
+
+	if len(done) != 0 || s.Len() != 3 {
+		t.Fatalf("Expected no expired threads, but got %d", len(done))
+	}
+
+	s.Emit(&MailThread{Id: "A4", seen: at.Add(135 * time.Minute)})
+
+	if len(done) != 2 || done[0].Id != "A2" || done[1].Id != "A1" || !done[0].IsIncomplete() {
+		t.Fatalf("Expected A2 and A1 expired, but got %v", done)
+	}
+
+	if s.Len() != 2 || s.lru.Len() != 2 || len(s.elems) != 2 {
+		t.Errorf("Unexpected storage length %d", s.Len())
+	}
+
+	// Limit evicts the least recently seen
+	s.SetMaxThreads(2)
+	s.Emit(&MailThread{Id: "A5", seen: at.Add(136 * time.Minute)})
+
+	if len(done) != 3 || done[2].Id != "A3" {
+		t.Fatalf("Expected A3 evicted, but got %v", done)
+	}
+
+	if c := s.GetCounters(); c.Expired != 2 || c.Evicted != 1 || c.Threads != 3 {
+		t.Errorf("Unexpected counters %v", c)
+	}
+
+	// Removed thread is not tracked
+	s.Emit(&MailThread{Id: "A5", Removed: true, seen: at.Add(137 * time.Minute)})
+
+	if len(done) != 4 || done[3].Id != "A5" || done[3].IsIncomplete() || s.lru.Len() != 1 {
+		t.Errorf("Expected A5 completed, but got %v", done)
+	}
+}
+
+func TestStorageFlush(t *testing.T) {
+	var (
+		s      = NewStorage()
+		done   []*MailThread
+		events []ThreadFace
+	)
+
+	s.SetPendingWindow(time.Minute)
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+	s.SetEventCb(func(v ThreadFace, args ...interface{}) error {
+		events = append(events, v)
+
+		return nil
+	})
+
+	s.Emit(&MailThread{Id: "A1", childId: "A2"})
+	s.Emit(&MailThread{Id: "A2", SpamScore: 1})
+	s.Emit(&MailThread{Id: "A3"})
+	s.Emit(&Spam{QueueId: "A4", Score: 1})
+	s.Emit(&ScreenEvent{Client: &Client{IP: "1.1.1.1"}, Action: ScreenConnect})
+
+	s.Flush()
+
+	if len(done) != 2 || done[0].Id != "A1" || done[1].Id != "A3" || !done[0].IsIncomplete() {
+		t.Fatalf("Expected A1 and A3 flushed, but got %v", done)
+	}
+
+	if len(events) != 1 || s.Len() != 0 || s.lru.Len() != 0 {
+		t.Errorf("Expected empty storage, but got %d threads and %d events", s.Len(), len(events))
+	}
+
+	if c := s.GetCounters(); c.Flushed != 2 || c.Unmatched != 1 || c.Verdicts != 1 {
+		t.Errorf("Unexpected counters %v", c)
+	}
+}
+
+func TestStorageCompleteWindow(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+			`Nov 22 02:24:53 mx postfix/cleanup[6224]: B29AFB08A08A: message-id=<abcd@localhost>`,
+			`Nov 22 02:24:55 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+			// Verdict from the other log
+			`Nov 22 02:24:54 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:30 mx postfix/smtpd[6223]: C39AFB08A08A: client=unknown[2.2.2.2]`,
+			`Nov 22 02:25:31 mx postfix/qmgr[1234]: C39AFB08A08A: removed`,
+		}
+		done []*MailThread
+	)
+
+	s.SetCompleteWindow(30 * time.Second)
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+
+	for _, l := range m[:4] {
+		if _, err := s.Parse(l); err != nil && err != ErrorStrFormatNotSupported {
+			t.Fatalf("Unexpected error %s at %s", err.Error(), l)
+		}
+	}
+
+	if len(done) != 0 {
+		t.Fatalf("Expected thread is kept within the window, but got %v", done)
+	}
+
+	for _, l := range m[4:] {
+		s.Parse(l)
+	}
+
+	if len(done) != 1 || done[0].Id != "B29AFB08A08A" || done[0].GetSpamScore() != 1 || done[0].IsIncomplete() {
+		t.Fatalf("Expected spam thread completed after the window, but got %v", done)
+	}
+
+	// Removed thread is restored with its state
+	var buf bytes.Buffer
+
+	s.Save(&buf)
+	r := NewStorage()
+	r.SetThreadDoneCb(s.threadDone)
+	r.Load(&buf)
+	r.Flush()
+
+	if len(done) != 2 || done[1].Id != "C39AFB08A08A" || done[1].IsIncomplete() {
+		t.Errorf("Expected removed thread completed on flush, but got %v", done)
+	}
+}
+
+func TestStorageSourceIdle(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []struct{ source, text string }{
+			{"spam.log", `Nov 22 02:24:00 mx spamd[5818]: spamd: clean message (0.0/5.0) for nobody:99 in 0.1 seconds, 1024 bytes.`},
+			{"mail.log", `Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`},
+			{"mail.log", `Nov 22 02:24:55 mx postfix/qmgr[1234]: B29AFB08A08A: removed`},
+			{"mail.log", `Nov 22 02:28:00 mx postfix/smtpd[6223]: C39AFB08A08A: client=unknown[2.2.2.2]`},
+			// Spam log is quiet for the idle time
+			{"mail.log", `Nov 22 02:30:00 mx postfix/smtpd[6223]: D49AFB08A08A: client=unknown[3.3.3.3]`},
+		}
+		done []*MailThread
+	)
+
+	s.SetCompleteWindow(30 * time.Second)
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v.(*MailThread))
+
+		return nil
+	})
+
+	for i, l := range m {
+		at, _ := getTime(l.text)
+		v, err := Parse(l.text)
+
+		s.emitLine(&Line{Text: l.text, Source: l.source}, at, v, err)
+
+		if i == 3 && len(done) != 0 {
+			t.Fatalf("Expected thread waits for the lagging log, but got %v", done)
+		}
+	}
+
+	if len(done) != 1 || done[0].Id != "B29AFB08A08A" || len(s.sources) != 1 {
+		t.Errorf("Expected idle log forgotten and thread completed, but got %v", done)
+	}
+}
+
+func TestStoragePendingSpam(t *testing.T) {
+	var (
+		s = NewStorage()
+		m = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: B29AFB08A08A: client=unknown[1.1.1.1]`,
+			`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<abcd@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<lost@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:05 mx postfix/cleanup[6224]: B29AFB08A08A: message-id=<abcd@localhost>`,
+			`Nov 22 02:27:05 mx postfix/qmgr[1234]: B29AFB08A08A: removed`,
+		}
+		done *MailThread
+	)
+
+	s.SetPendingWindow(time.Minute)
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = v.(*MailThread)
+
+		return nil
+	})
+
+	for _, l := range m {
+		if _, err := s.Parse(l); err != nil {
+			t.Fatalf("Unexpected error %s on %s", err.Error(), l)
+		}
+	}
+
+	if done == nil || done.GetSpamScore() != 1 {
+		t.Fatalf("Expected buffered verdict applied, but got %v", done)
+	}
+
+	if c := s.GetCounters(); c.Pending != 2 || c.Matched != 1 || c.Unmatched != 1 {
+		t.Errorf("Unexpected counters %v", c)
+	}
+
+	if len(s.pending) != 0 {
+		t.Errorf("Expected empty buffer, but got %d", len(s.pending))
+	}
+
+	// Verdict logged out of order is out of window by its own log time
+	r := NewStorage()
+	r.SetPendingWindow(time.Minute)
+	r.Parse(m[4])
+
+	if _, err := r.Parse(m[2]); err != nil || r.GetCounters().Unmatched != 1 {
+		t.Errorf("Expected late verdict dropped, but got %v, %v", err, r.GetCounters())
+	}
+
+	// Buffer is disabled
+	s.SetPendingWindow(0)
+
+	if _, err := s.Parse(m[2]); err != ErrorUnknownSpamItem {
+		t.Errorf("Expected ErrorUnknownSpamItem, but got %v", err)
+	}
+}
+
+func TestPipeline(t *testing.T) {
+	var (
+		s     = NewStorage()
+		p     = NewPipeline(s, 4)
+		lines = make(chan *Line)
+		done  []ThreadFace
+		n     int
+		tpl   = []string{
+			`Nov 22 02:24:53 mx postfix/smtpd[6223]: %s: client=unknown[1.1.1.1]`,
+			`Nov 22 02:24:53 mx postfix/cleanup[6224]: %s: message-id=<%s@localhost>`,
+			`Nov 22 02:25:04 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<%s@localhost>,bayes=1.000000,autolearn=no`,
+			`Nov 22 02:25:05 mx postfix/qmgr[1234]: %s: removed`,
+			`Nov 22 02:25:05 mx kernel: eth0 up`,
+		}
+	)
+
+	s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+		done = append(done, v)
+
+		return nil
+	})
+
+	p.SetResultCb(func(line *Line, v interface{}, err error) {
+		n++
+	})
+
+	go func() {
+		for i := 0; i < 200; i++ {
+			id := fmt.Sprintf("%X", 0xA0000+i)
+
+			for _, l := range tpl {
+				switch strings.Count(l, "%s") {
+				case 2:
+					l = fmt.Sprintf(l, id, id)
+				case 1:
+					l = fmt.Sprintf(l, id)
+				}
+
+				lines <- &Line{Text: l}
+			}
+		}
+
+		close(lines)
+	}()
+
+	p.Run(lines)
+
+	if n != 1000 {
+		t.Errorf("Expected 1000 lines, but got %d", n)
+	}
+
+	if len(done) != 200 {
+		t.Fatalf("Expected 200 threads, but got %d", len(done))
+	}
+
+	for i, v := range done {
+		if id := fmt.Sprintf("%X", 0xA0000+i); v.GetId() != id || v.GetSpamScore() != 1 {
+			t.Errorf("Expected spam thread %s in the log order, but got %s", id, v.GetId())
+		}
+	}
+}
+
+func TestPipelineSources(t *testing.T) {
+	var (
+		mail = []string{
+			`Nov 22 03:%02d:00 mx postfix/smtpd[6223]: %X: client=unknown[1.1.1.1]`,
+			`Nov 22 03:%02d:00 mx postfix/cleanup[6224]: %X: message-id=<%X@localhost>`,
+			`Nov 22 03:%02d:05 mx postfix/qmgr[1234]: %X: removed`,
+		}
+		verdict = `Nov 22 03:%02d:02 mx spamd[5818]: spamd: result: Y 12 - BAYES_99 scantime=0.9,size=2455,user=nobody,uid=99,required_score=5.0,rhost=localhost,raddr=127.0.0.1,rport=43950,mid=<%X@localhost>,bayes=1.000000,autolearn=no`
+		other   = `Nov 22 03:%02d:00 mx kernel: eth0 up`
+	)
+
+	// Lines of the source for the minute, the source is read from the other minute
+	read := func(lines chan<- *Line, source string, i int) {
+		id := 0xA0000 + i
+
+		switch {
+		case i < 0:
+			lines <- &Line{Text: fmt.Sprintf(other, 10+i), Source: source}
+
+		case i >= 10:
+
+		case source == "mail.log":
+			for _, l := range mail {
+				if strings.Count(l, "%X") == 2 {
+					l = fmt.Sprintf(l, 10+i, id, id)
+				} else {
+					l = fmt.Sprintf(l, 10+i, id)
+				}
+
+				lines <- &Line{Text: l, Source: source}
+			}
+
+		default:
+			lines <- &Line{Text: fmt.Sprintf(verdict, 10+i, id), Source: source}
+		}
+	}
+
+	for _, ahead := range []string{"mail.log", "spam.log"} {
+		var (
+			s     = NewStorage()
+			p     = NewPipeline(s, 4)
+			lines = make(chan *Line)
+			done  []ThreadFace
+		)
+
+		// Source lags by more than time to live
+		s.SetTTL(2 * time.Minute)
+		s.SetPendingWindow(time.Minute)
+		s.SetCompleteWindow(time.Minute)
+		s.SetThreadDoneCb(func(v ThreadFace, args ...interface{}) error {
+			done = append(done, v)
+
+			return nil
+		})
+
+		// One source is 5 minutes ahead of the other
+		go func(ahead string) {
+			for k := 0; k < 15; k++ {
+				for _, source := range []string{"mail.log", "spam.log"} {
+					if source == ahead {
+						read(lines, source, k)
+					} else {
+						read(lines, source, k-5)
+					}
+				}
+			}
+
+			close(lines)
+		}(ahead)
+
+		p.Run(lines)
+		s.Flush()
+
+		if len(done) != 10 {
+			t.Fatalf("Expected 10 threads, but got %d", len(done))
+		}
+
+		for _, v := range done {
+			if v.GetSpamScore() != 1 {
+				t.Errorf("Expected spam thread %s with %s ahead", v.GetId(), ahead)
+			}
+		}
+
+		if c := s.GetCounters(); c.Verdicts != 10 || c.Unmatched != 0 || c.Expired != 0 {
+			t.Errorf("Expected all verdicts matched with %s ahead, but got %v", ahead, c)
+		}
+	}
+}
+
+func TestStorageState(t *testing.T) {
+	var (
+		s   = NewStorage()
+		r   = NewStorage()
+		at  = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+		buf bytes.Buffer
+	)
+
+	s.SetPendingWindow(time.Minute)
+	s.Emit(&MailThread{Id: "A1", MsgId: "abcd@localhost", childId: "A2", Client: &Client{IP: "1.1.1.1", At: at}, seen: at})
+	s.Emit(&MailThread{Id: "A2", MsgId: "abcd@localhost", seen: at.Add(time.Second)})
+	s.Emit(&Spam{QueueId: "A1", QueuedAs: "A2", Score: 1, Hits: 7.5, Rules: []string{"BAYES_99"}})
+	s.Emit(&Spam{QueueId: "B1", Score: 1})
+
+	if err := s.Save(&buf); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if err := r.Load(bytes.NewReader(buf.Bytes())); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if r.Len() != 2 || len(r.pending) != 1 || r.lru.Len() != 2 {
+		t.Fatalf("Unexpected restored storage %d threads, %d verdicts", r.Len(), len(r.pending))
+	}
+
+	if v := r.Get("A2"); v.parentId != "A1" || v.GetSpamScore() != 1 || v.spamScans != 1 || v.GetSpamRules() != "BAYES_99" {
+		t.Errorf("Unexpected restored child thread %v", v)
+	}
+
+	if v := r.Get("A1"); v.childId != "A2" || v.GetFromIp() != "1.1.1.1" || !v.GetTime().Equal(at) {
+		t.Errorf("Unexpected restored parent thread %v", v)
+	}
+
+	if v := r.GetByMessageId("abcd@localhost"); len(v) != 2 {
+		t.Errorf("Expected restored index, but got %v", v)
+	}
+
+	if c := r.GetCounters(); c.Pending != 1 {
+		t.Errorf("Unexpected restored counters %v", c)
+	}
+
+	// Pending verdict is applied to the thread after restart
+	r.Emit(&MailThread{Id: "B1", seen: at.Add(2 * time.Second)})
+
+	if v := r.Get("B1"); v.GetSpamScore() != 1 {
+		t.Errorf("Expected pending verdict applied, but got %d", v.GetSpamScore())
+	}
+
+	// Other version
+	buf.Reset()
+	gob.NewEncoder(&buf).Encode(&stateHeader{Name: "postlog-sa", Version: StateVersion + 1})
+
+	if err := NewStorage().Load(&buf); err != ErrorStateVersion {
+		t.Errorf("Expected ErrorStateVersion, but got %v", err)
+	}
+
+	if err := NewStorage().Load(strings.NewReader("garbage")); err != ErrorStateVersion {
+		t.Errorf("Expected ErrorStateVersion, but got %v", err)
+	}
+}
+
+func TestStorageStateFile(t *testing.T) {
+	var (
+		s    = NewStorage()
+		r    = NewStorage()
+		name = filepath.Join(t.TempDir(), "state")
+	)
+
+	if err := r.LoadFile(name); err != nil {
+		t.Errorf("Expected missing file is not error, but got %s", err.Error())
+	}
+
+	s.Set(&MailThread{Id: "A1"})
+
+	if err := s.SaveFile(name); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if err := r.LoadFile(name); err != nil || r.Get("A1") == nil {
+		t.Fatalf("Expected restored thread, but got %v", err)
+	}
+
+	if _, err := os.Stat(name); err != nil {
+		t.Errorf("Expected state file is kept after load, but got %s", err.Error())
+	}
+
+	// Snapshot is written from the function called with storage locked
+	s.emitLine(&Line{Pos: Checkpoint{File: "/var/log/maillog", Inode: 7, Offset: 42}}, time.Time{}, nil, ErrorStrFormatNotSupported)
+
+	if err := s.Snapshot(func(state []byte) {
+		if err := WriteStateFile(name, state); err != nil {
+			t.Errorf("Unexpected error %s", err.Error())
+		}
+	}); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	r = NewStorage()
+
+	if err := r.LoadFile(name); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if v := r.GetCheckpoints(); len(v) != 1 || v[0].Offset != 42 || v[0].Inode != 7 {
+		t.Errorf("Expected checkpoint at 42, but got %v", v)
+	}
+
+	// Incompatible file is removed
+	if err := ioutil.WriteFile(name, []byte("state"), 0644); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if err := r.LoadFile(name); err != ErrorStateVersion {
+		t.Errorf("Expected %s, but got %v", ErrorStateVersion, err)
+	}
+
+	if _, err := os.Stat(name); !os.IsNotExist(err) {
+		t.Errorf("Expected incompatible state file is removed")
+	}
+}
@@ -0,0 +1,39 @@
+package filter
+
+// Secondary storage index: key to the set of threads
+type threadIndex map[string]map[*MailThread]bool
+
+// Add thread to the key set
+func (this threadIndex) add(key string, m *MailThread) {
+	if key == "" {
+		return
+	}
+
+	set, ok := this[key]
+	if !ok {
+		set = make(map[*MailThread]bool)
+		this[key] = set
+	}
+
+	set[m] = true
+}
+
+// Remove thread from the key set
+func (this threadIndex) remove(key string, m *MailThread) {
+	if set, ok := this[key]; ok {
+		delete(set, m)
+
+		if len(set) == 0 {
+			delete(this, key)
+		}
+	}
+}
+
+// Get threads with key
+func (this threadIndex) get(key string) (v []*MailThread) {
+	for m := range this[key] {
+		v = append(v, m)
+	}
+
+	return
+}
@@ -0,0 +1,177 @@
+package filter
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrorUnknownParser = errors.New("Unknown parser")
+	ErrorParserExists  = errors.New("Parser with same name exists")
+)
+
+// Log source parser. Parse returns ErrorStrFormatNotSupported
+// if the line does not belong to the source, otherwise the result
+// is one of *MailThread, *Reject, *ScreenEvent or *Spam
+type Parser interface {
+	Name() string
+	Parse(str string) (interface{}, error)
+}
+
+// Parser built from the function
+type parserFunc struct {
+	name string
+	fn   func(str string) (interface{}, error)
+}
+
+type registry struct {
+	mu       sync.RWMutex
+	list     []Parser
+	disabled map[string]bool
+}
+
+// Registered parsers in the check order
+var parsers = &registry{
+	disabled: make(map[string]bool),
+}
+
+func init() {
+	RegisterParser(NewParser("postfix", func(str string) (interface{}, error) {
+		m, err := NewMailThread(str)
+		if err != nil {
+			return nil, err
+		}
+
+		return m, nil
+	}))
+
+	RegisterParser(NewParser("reject", func(str string) (interface{}, error) {
+		r, err := NewReject(str)
+		if err != nil {
+			return nil, err
+		}
+
+		return r, nil
+	}))
+
+	RegisterParser(NewParser("postscreen", func(str string) (interface{}, error) {
+		e, err := NewScreenEvent(str)
+		if err != nil {
+			return nil, err
+		}
+
+		return e, nil
+	}))
+
+	for _, p := range spamParsers {
+		fn := p.fn
+
+		RegisterParser(NewParser(p.name, func(str string) (interface{}, error) {
+			s, err := fn(str)
+			if err != nil {
+				return nil, err
+			}
+
+			if s == nil {
+				return nil, ErrorStrFormatNotSupported
+			}
+
+			s.at, _ = getTime(str)
+
+			return s, nil
+		}))
+	}
+}
+
+// Create parser from the function
+func NewParser(name string, fn func(str string) (interface{}, error)) Parser {
+	return &parserFunc{
+		name: name,
+		fn:   fn,
+	}
+}
+
+// Get parser name
+func (this *parserFunc) Name() string {
+	return this.name
+}
+
+// Parse log line
+func (this *parserFunc) Parse(str string) (interface{}, error) {
+	return this.fn(str)
+}
+
+// Add parser to the end of the check list
+func RegisterParser(p Parser) error {
+	parsers.mu.Lock()
+	defer parsers.mu.Unlock()
+
+	for _, v := range parsers.list {
+		if v.Name() == p.Name() {
+			return ErrorParserExists
+		}
+	}
+
+	parsers.list = append(parsers.list, p)
+
+	return nil
+}
+
+// Enable or disable registered parser
+func EnableParser(name string, v bool) error {
+	parsers.mu.Lock()
+	defer parsers.mu.Unlock()
+
+	for _, p := range parsers.list {
+		if p.Name() == name {
+			parsers.disabled[name] = !v
+
+			return nil
+		}
+	}
+
+	return ErrorUnknownParser
+}
+
+// Check if parser is registered
+func HasParser(name string) bool {
+	parsers.mu.RLock()
+	defer parsers.mu.RUnlock()
+
+	for _, p := range parsers.list {
+		if p.Name() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Get enabled parsers in the check order
+func GetParsers() (v []Parser) {
+	parsers.mu.RLock()
+	defer parsers.mu.RUnlock()
+
+	for _, p := range parsers.list {
+		if !parsers.disabled[p.Name()] {
+			v = append(v, p)
+		}
+	}
+
+	return
+}
+
+// Run log line through enabled parsers, the first recognized result is returned
+func Parse(str string) (v interface{}, err error) {
+	for _, p := range GetParsers() {
+		if v, err = p.Parse(str); err == nil {
+			return v, nil
+		}
+
+		if err != ErrorStrFormatNotSupported {
+			return nil, err
+		}
+	}
+
+	return nil, ErrorStrFormatNotSupported
+}
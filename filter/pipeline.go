@@ -0,0 +1,122 @@
+package filter
+
+import (
+	"runtime"
+	"sync"
+	"time"
+)
+
+// Log line with its source and position after the line
+type Line struct {
+	Text   string
+	Source string
+	Pos    Checkpoint
+}
+
+// Parsed log line
+type pipelineItem struct {
+	seq  uint64
+	line *Line
+	at   time.Time
+	v    interface{}
+	err  error
+}
+
+// Parallel parsing pipeline: reader numbers lines, workers parse them
+// and results are emitted to the storage in the read order, so each
+// thread gets its lines in the log order
+type Pipeline struct {
+	store   *Storage
+	workers int
+	result  func(line *Line, v interface{}, err error)
+
+	// Line year is guessed in the emit order
+	clock *TimeParser
+}
+
+// Create pipeline, number of workers is the number of CPUs if zero
+func NewPipeline(s *Storage, workers int) *Pipeline {
+	if workers <= 0 {
+		workers = runtime.NumCPU()
+	}
+
+	return &Pipeline{
+		store:   s,
+		workers: workers,
+		result:  func(line *Line, v interface{}, err error) {},
+		clock:   NewTimeParser(time.Local),
+	}
+}
+
+// Set call back func on each emitted line with parser result and error
+func (this *Pipeline) SetResultCb(fn func(line *Line, v interface{}, err error)) {
+	this.result = fn
+}
+
+// Read lines until channel is closed, args are passed to the storage callbacks
+func (this *Pipeline) Run(lines <-chan *Line, args ...interface{}) {
+	var (
+		wg      sync.WaitGroup
+		jobs    = make(chan *pipelineItem, this.workers*64)
+		results = make(chan *pipelineItem, this.workers*64)
+	)
+
+	// Reader
+	go func() {
+		var seq uint64
+
+		for line := range lines {
+			jobs <- &pipelineItem{seq: seq, line: line}
+			seq++
+		}
+
+		close(jobs)
+	}()
+
+	// Parsers
+	for i := 0; i < this.workers; i++ {
+		wg.Add(1)
+
+		go func() {
+			defer wg.Done()
+
+			for item := range jobs {
+				item.v, item.err = Parse(item.line.Text)
+				results <- item
+			}
+		}()
+	}
+
+	go func() {
+		wg.Wait()
+		close(results)
+	}()
+
+	// Emit in the read order
+	var (
+		next    uint64
+		waiting = make(map[uint64]*pipelineItem)
+	)
+
+	for item := range results {
+		waiting[item.seq] = item
+
+		for {
+			if item = waiting[next]; item == nil {
+				break
+			}
+
+			delete(waiting, next)
+			next++
+
+			if at, err := this.clock.Parse(item.line.Text); err == nil {
+				item.at = at
+				setLineTime(item.v, at)
+			}
+
+			item.err = this.store.emitLine(item.line, item.at, item.v, item.err, args...)
+
+			this.result(item.line, item.v, item.err)
+		}
+	}
+}
@@ -0,0 +1,79 @@
+package filter
+
+import (
+	"strconv"
+)
+
+// Recipient delivery status
+const (
+	StatusSent     = "sent"
+	StatusDeferred = "deferred"
+	StatusBounced  = "bounced"
+	StatusExpired  = "expired"
+	StatusRejected = "rejected"
+)
+
+// Postfix delivery agents which log recipient status
+var deliveryAgents = []string{"smtp", "lmtp", "pipe", "local", "virtual", "error", "retry", "discard"}
+
+type Recipient struct {
+	Address,
+	OrigTo,
+	Relay,
+	Dsn,
+	Status string
+	// Time in seconds from mail arrival to the delivery attempt
+	Delay float64
+}
+
+// Get recipient delivery information
+func getRecipient(str string) (v *Recipient) {
+	var (
+		res []string
+		ok  bool
+	)
+
+	ok, res = IsPostfix(str, deliveryAgents)
+	if !ok || len(res) < 5 {
+		return nil
+	}
+
+	if res = rcptRe.FindStringSubmatch(res[4]); len(res) < 6 {
+		return nil
+	}
+
+	v = &Recipient{
+		Address: res[1],
+		OrigTo:  res[2],
+		Relay:   res[3],
+		Dsn:     res[5],
+		Status:  getSmtpStatus(str),
+	}
+
+	v.Delay, _ = strconv.ParseFloat(res[4], 64)
+
+	return v
+}
+
+// Update delivery information with the later attempt
+func (this *Recipient) apply(r *Recipient) {
+	if r.OrigTo != "" {
+		this.OrigTo = r.OrigTo
+	}
+
+	if r.Relay != "" {
+		this.Relay = r.Relay
+	}
+
+	if r.Dsn != "" {
+		this.Dsn = r.Dsn
+	}
+
+	if r.Status != "" {
+		this.Status = r.Status
+	}
+
+	if r.Delay > 0 {
+		this.Delay = r.Delay
+	}
+}
@@ -0,0 +1,209 @@
+package filter
+
+import (
+	"strings"
+	"time"
+)
+
+// Id value of the reject event, message was not queued
+const RejectId = "NOQUEUE"
+
+// Mail rejected by smtpd before it was queued
+type Reject struct {
+	Client   *Client
+	Instance string
+
+	// SMTP stage: CONNECT, HELO, MAIL, RCPT, DATA, END-OF-MESSAGE
+	Stage string
+	// SMTP reply code and enhanced status code
+	Code,
+	Dsn string
+	Reason string
+
+	Helo,
+	From,
+	To,
+	Proto string
+}
+
+// Check if string is reject message and create reject event
+func NewReject(str string) (r *Reject, err error) {
+	var (
+		res []string
+		ok  bool
+	)
+
+	ok, res = IsPostfix(str, smtpdServices)
+	if !ok || len(res) < 6 || strings.ToUpper(res[3]) != RejectId {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	if r = parseReject(res[4]); r == nil {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	r.Instance = res[5]
+
+	if t, err := getTime(str); err == nil {
+		r.Client.At = t
+	}
+
+	return r, nil
+}
+
+// Parse reject message text following the queue id
+func parseReject(str string) (r *Reject) {
+	var (
+		res []string
+	)
+
+	if res = rejectRe.FindStringSubmatch(str); len(res) < 7 {
+		return nil
+	}
+
+	r = &Reject{
+		Client: &Client{
+			Name: res[2],
+			IP:   trimIp(res[3]),
+		},
+		Stage: strings.ToUpper(res[1]),
+		Code:  res[4],
+		Dsn:   res[5],
+	}
+
+	// Reason text is followed by the envelope parameters
+	i := strings.LastIndex(res[6], "; from=<")
+	if i == -1 {
+		i = strings.LastIndex(res[6], "; proto=")
+	}
+
+	if i == -1 {
+		r.Reason = res[6]
+
+		return r
+	}
+
+	r.Reason = res[6][:i]
+
+	for _, p := range rejectParamRe.FindAllStringSubmatch(res[6][i+1:], -1) {
+		switch strings.ToLower(p[1]) {
+		case "from":
+			r.From = p[2]
+		case "to":
+			r.To = p[2]
+		case "proto":
+			r.Proto = p[2]
+		case "helo":
+			r.Helo = p[2]
+		}
+	}
+
+	return r
+}
+
+// Get event ID
+func (this *Reject) GetId() string {
+	return RejectId
+}
+
+// Get postfix instance syslog_name
+func (this *Reject) GetInstance() string {
+	return this.Instance
+}
+
+// Rejected mail does not have child thread
+func (this *Reject) GetChildId() string {
+	return ""
+}
+
+// Rejected mail does not have notification
+func (this *Reject) GetBounceId() string {
+	return ""
+}
+
+// Rejected mail is not notification
+func (this *Reject) GetBounceOf() string {
+	return ""
+}
+
+// Rejected mail does not have message id
+func (this *Reject) GetMessageId() string {
+	return ""
+}
+
+// Get from value
+func (this *Reject) GetFrom() string {
+	return this.From
+}
+
+// Get client ip
+func (this *Reject) GetFromIp() (v string) {
+	if this.Client != nil {
+		v = this.Client.GetIp()
+	}
+	return v
+}
+
+// Rejected client is not authenticated
+func (this *Reject) GetSaslUser() string {
+	return ""
+}
+
+// Rejected mail is not local submission
+func (this *Reject) GetUid() string {
+	return ""
+}
+
+// Return time value when mail was rejected
+func (this *Reject) GetTime() (t time.Time) {
+	if this.Client != nil {
+		t = this.Client.At
+	}
+	return t
+}
+
+// Each reject counts as one spam victim
+func (this *Reject) GetSpamScore() uint {
+	return 1
+}
+
+// Reject does not have scanner score
+func (this *Reject) GetSpamHits() float64 {
+	return 0
+}
+
+// Reject does not have scanner threshold
+func (this *Reject) GetSpamRequired() float64 {
+	return 0
+}
+
+// Reject does not have scanner rules
+func (this *Reject) GetSpamRules() string {
+	return ""
+}
+
+// Reject does not have viruses
+func (this *Reject) GetViruses() string {
+	return ""
+}
+
+// Reject does not have viruses
+func (this *Reject) IsInfected() bool {
+	return false
+}
+
+// Get rejected recipient
+func (this *Reject) GetRecipients() []*Recipient {
+	return []*Recipient{
+		&Recipient{
+			Address: this.To,
+			Dsn:     this.Dsn,
+			Status:  StatusRejected,
+		},
+	}
+}
+
+// Get rejected recipient address
+func (this *Reject) GetTo() string {
+	return this.To
+}
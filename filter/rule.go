@@ -0,0 +1,169 @@
+package filter
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// User defined rule kinds
+const (
+	RuleSpam   = "spam"
+	RuleThread = "thread"
+)
+
+// Capture group names mapped by the user defined rules of the kind
+var ruleGroups = map[string]map[string]bool{
+	RuleSpam: {
+		"queue_id":   true,
+		"queued_as":  true,
+		"message_id": true,
+		"score":      true,
+		"hits":       true,
+		"required":   true,
+		"rules":      true,
+		"category":   true,
+		"action":     true,
+		"virus":      true,
+	},
+	RuleThread: {
+		"queue_id":   true,
+		"message_id": true,
+		"from":       true,
+	},
+}
+
+// User defined regex rule, named capture groups are mapped
+// to the mail thread or spam verdict fields
+type Rule struct {
+	name string
+	kind string
+	re   *regexp.Regexp
+}
+
+// Compile user defined rule, kind is `spam' if empty
+func NewRule(name, kind, expr string) (r *Rule, err error) {
+	var (
+		ids int
+	)
+
+	if kind == "" {
+		kind = RuleSpam
+	}
+
+	if kind != RuleSpam && kind != RuleThread {
+		return nil, fmt.Errorf("Rule %s: unknown kind `%s'", name, kind)
+	}
+
+	r = &Rule{
+		name: name,
+		kind: kind,
+	}
+
+	if r.re, err = regexp.Compile(expr); err != nil {
+		return nil, fmt.Errorf("Rule %s: %s", name, err.Error())
+	}
+
+	for _, g := range r.re.SubexpNames() {
+		if g == "" {
+			continue
+		}
+
+		if !ruleGroups[RuleSpam][g] && !ruleGroups[RuleThread][g] {
+			return nil, fmt.Errorf("Rule %s: unknown capture group `%s'", name, g)
+		}
+
+		if !ruleGroups[kind][g] {
+			return nil, fmt.Errorf("Rule %s: capture group `%s' is not used by %s rules", name, g, kind)
+		}
+
+		switch g {
+		case "queue_id", "queued_as", "message_id":
+			ids++
+		}
+	}
+
+	if ids == 0 {
+		return nil, fmt.Errorf("Rule %s: queue_id, queued_as or message_id capture group is required", name)
+	}
+
+	if kind == RuleThread && r.re.SubexpIndex("queue_id") < 0 {
+		return nil, fmt.Errorf("Rule %s: queue_id capture group is required", name)
+	}
+
+	return r, nil
+}
+
+// Get rule name
+func (this *Rule) Name() string {
+	return this.name
+}
+
+// Parse log line
+func (this *Rule) Parse(str string) (v interface{}, err error) {
+	var (
+		res []string
+		g   = make(map[string]string)
+	)
+
+	if res = this.re.FindStringSubmatch(str); res == nil {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	for i, n := range this.re.SubexpNames() {
+		if n != "" && res[i] != "" {
+			g[n] = res[i]
+		}
+	}
+
+	if this.kind == RuleThread {
+		m := &MailThread{
+			Id:    strings.ToUpper(g["queue_id"]),
+			MsgId: strings.Trim(g["message_id"], "<>"),
+			From:  g["from"],
+		}
+
+		// Thread expires by the log time like postfix threads,
+		// time is kept until the thread gets its client
+		if m.seen, _ = getTime(str); !m.seen.IsZero() {
+			m.Client = &Client{At: m.seen}
+		}
+
+		return m, nil
+	}
+
+	s := &Spam{
+		MsgId:    strings.Trim(g["message_id"], "<>"),
+		QueueId:  g["queue_id"],
+		QueuedAs: g["queued_as"],
+		Category: strings.ToUpper(g["category"]),
+		Action:   strings.ToLower(g["action"]),
+		Rules:    splitRules(g["rules"]),
+		Scanner:  this.name,
+	}
+
+	s.at, _ = getTime(str)
+
+	if sc, ok := g["score"]; ok {
+		if f, err := strconv.ParseFloat(sc, 64); err == nil && f > 0 {
+			s.Score = uint(f)
+		}
+	}
+
+	s.Hits, _ = strconv.ParseFloat(g["hits"], 64)
+	s.Required, _ = strconv.ParseFloat(g["required"], 64)
+
+	// Score by the category or hits when rule has no score
+	if _, ok := g["score"]; !ok {
+		if IsSpamCategory(s.Category) || (s.Required > 0 && s.Hits >= s.Required) {
+			s.Score = 1
+		}
+	}
+
+	if vr, ok := g["virus"]; ok {
+		s.Viruses = []string{vr}
+	}
+
+	return s, nil
+}
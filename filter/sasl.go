@@ -0,0 +1,150 @@
+package filter
+
+import (
+	"sync"
+	"time"
+)
+
+// Authenticated user activity which exceeded thresholds
+type SaslActivity struct {
+	User       string
+	Spam       uint
+	Recipients uint
+	Since      time.Time
+}
+
+// Detect compromised accounts: count spam verdicts and recipients
+// of the authenticated user within the log time window
+type SaslDetector struct {
+	mu sync.Mutex
+
+	// Activity window
+	window time.Duration
+	// Thresholds, zero value disables check
+	maxSpam,
+	maxRcpt uint
+
+	users map[string]*saslUser
+	// Log time of the last idle users removal
+	swept time.Time
+}
+
+type saslUser struct {
+	events  []saslEvent
+	flagged time.Time
+}
+
+type saslEvent struct {
+	at   time.Time
+	spam bool
+	rcpt uint
+}
+
+// Create detector
+func NewSaslDetector(window time.Duration, spam, rcpt uint) *SaslDetector {
+	return &SaslDetector{
+		window:  window,
+		maxSpam: spam,
+		maxRcpt: rcpt,
+		users:   make(map[string]*saslUser),
+	}
+}
+
+// Add thread to the user activity, activity is returned once per window
+// if user exceeded any threshold
+func (this *SaslDetector) Check(m ThreadFace) (v *SaslActivity) {
+	var (
+		user *saslUser
+		name = m.GetSaslUser()
+		at   = m.GetTime()
+		ok   bool
+	)
+
+	if name == "" {
+		return nil
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// Users are checked once per window
+	if !at.IsZero() && at.Sub(this.swept) >= this.window {
+		this.sweep(at)
+	}
+
+	if user, ok = this.users[name]; !ok {
+		user = &saslUser{}
+		this.users[name] = user
+	}
+
+	user.events = append(user.events, saslEvent{
+		at:   at,
+		spam: m.GetSpamScore() > 0 || m.IsInfected(),
+		rcpt: uint(len(m.GetRecipients())),
+	})
+
+	v = &SaslActivity{
+		User:  name,
+		Since: at,
+	}
+
+	// Drop events out of window
+	i := 0
+	for _, e := range user.events {
+		if at.Sub(e.at) >= this.window {
+			continue
+		}
+
+		user.events[i] = e
+		i++
+
+		if e.spam {
+			v.Spam++
+		}
+
+		v.Recipients += e.rcpt
+
+		if e.at.Before(v.Since) {
+			v.Since = e.at
+		}
+	}
+	user.events = user.events[:i]
+
+	if (this.maxSpam == 0 || v.Spam < this.maxSpam) &&
+		(this.maxRcpt == 0 || v.Recipients < this.maxRcpt) {
+		return nil
+	}
+
+	// User was reported within window
+	if !user.flagged.IsZero() && at.Sub(user.flagged) < this.window {
+		return nil
+	}
+
+	user.flagged = at
+
+	return v
+}
+
+// Remove users without events and report within window
+func (this *SaslDetector) sweep(now time.Time) {
+	this.swept = now
+
+	for name, user := range this.users {
+		if !user.flagged.IsZero() && now.Sub(user.flagged) < this.window {
+			continue
+		}
+
+		idle := true
+		for _, e := range user.events {
+			if now.Sub(e.at) < this.window {
+				idle = false
+
+				break
+			}
+		}
+
+		if idle {
+			delete(this.users, name)
+		}
+	}
+}
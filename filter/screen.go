@@ -0,0 +1,276 @@
+package filter
+
+import (
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Id value of the postscreen connection, message was not queued
+const ScreenId = "POSTSCREEN"
+
+// Postscreen actions
+const (
+	ScreenConnect     = "CONNECT"
+	ScreenDnsbl       = "DNSBL"
+	ScreenListed      = "LISTED"
+	ScreenPassNew     = "PASS NEW"
+	ScreenPassOld     = "PASS OLD"
+	ScreenWhitelisted = "WHITELISTED"
+	ScreenBlacklisted = "BLACKLISTED"
+	ScreenDisconnect  = "DISCONNECT"
+	ScreenReject      = "NOQUEUE"
+)
+
+// Single postscreen or dnsblog log line
+type ScreenEvent struct {
+	Client   *Client
+	Instance string
+	Action   string
+
+	// DNSBL rank or listing domain from dnsblog
+	Rank  int
+	Dnsbl string
+
+	// Rejected recipient
+	Reject *Reject
+}
+
+// Postscreen connection aggregated by client ip
+type Screen struct {
+	Client   *Client
+	Instance string
+
+	// DNSBL rank and listing domains
+	Rank  int
+	Dnsbl []string
+	// Bot behaviour: PREGREET, HANGUP, COMMAND PIPELINING, etc.
+	Violations []string
+	// Last rejected recipient
+	Reject *Reject
+	// Final action: PASS NEW, PASS OLD, WHITELISTED or DISCONNECT
+	Result string
+}
+
+// Check if string is postscreen or dnsblog message and create event
+func NewScreenEvent(str string) (e *ScreenEvent, err error) {
+	var (
+		res []string
+		msg string
+	)
+
+	if res = screenRe.FindStringSubmatch(str); len(res) < 5 || !IsSyslogName(res[1]) {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	e = &ScreenEvent{
+		Instance: res[1],
+	}
+	msg = res[4]
+
+	switch {
+	case res[2] == "dnsblog":
+		if res = screenListedRe.FindStringSubmatch(msg); len(res) < 4 {
+			return nil, ErrorStrFormatNotSupported
+		}
+
+		e.Action = ScreenListed
+		e.Client = &Client{IP: trimIp(res[1])}
+		e.Dnsbl = res[2]
+
+	case strings.HasPrefix(msg, ScreenReject+": "):
+		if e.Reject = parseReject(msg[len(ScreenReject)+2:]); e.Reject == nil {
+			return nil, ErrorStrFormatNotSupported
+		}
+
+		e.Action = ScreenReject
+		e.Client = e.Reject.Client
+		e.Reject.Instance = e.Instance
+
+	default:
+		if res = screenDnsblRe.FindStringSubmatch(msg); len(res) > 2 {
+			e.Action = ScreenDnsbl
+			e.Rank, _ = strconv.Atoi(res[1])
+			e.Client = &Client{IP: trimIp(res[2])}
+
+			break
+		}
+
+		if res = screenActionRe.FindStringSubmatch(msg); len(res) < 3 {
+			return nil, ErrorStrFormatNotSupported
+		}
+
+		e.Action = res[1]
+		e.Client = &Client{IP: trimIp(res[2])}
+	}
+
+	if t, err := getTime(str); err == nil {
+		e.Client.At = t
+	}
+
+	return e, nil
+}
+
+// Check if connection is finished by postscreen or passed to smtpd
+func (this *ScreenEvent) IsFinal() bool {
+	switch this.Action {
+	case ScreenPassNew, ScreenPassOld, ScreenWhitelisted, ScreenDisconnect:
+		return true
+	}
+
+	return false
+}
+
+// Create connection from the first event
+func newScreen(e *ScreenEvent) *Screen {
+	return &Screen{
+		Client:   e.Client,
+		Instance: e.Instance,
+	}
+}
+
+// Add event to the connection
+func (this *Screen) apply(e *ScreenEvent) {
+	if this.Instance == "" {
+		this.Instance = e.Instance
+	}
+
+	switch e.Action {
+	case ScreenConnect:
+
+	case ScreenListed:
+		this.Dnsbl = appendUnique(this.Dnsbl, []string{e.Dnsbl})
+
+	case ScreenDnsbl:
+		if e.Rank > this.Rank {
+			this.Rank = e.Rank
+		}
+
+	case ScreenReject:
+		this.Reject = e.Reject
+
+	case ScreenPassNew, ScreenPassOld, ScreenWhitelisted, ScreenDisconnect:
+		this.Result = e.Action
+
+	default:
+		this.Violations = appendUnique(this.Violations, []string{e.Action})
+	}
+}
+
+// Get connection ID
+func (this *Screen) GetId() string {
+	return ScreenId
+}
+
+// Get postfix instance syslog_name
+func (this *Screen) GetInstance() string {
+	return this.Instance
+}
+
+// Connection does not have child thread
+func (this *Screen) GetChildId() string {
+	return ""
+}
+
+// Connection does not have notification
+func (this *Screen) GetBounceId() string {
+	return ""
+}
+
+// Connection is not notification
+func (this *Screen) GetBounceOf() string {
+	return ""
+}
+
+// Connection does not have message id
+func (this *Screen) GetMessageId() string {
+	return ""
+}
+
+// Get from value of the rejected recipient
+func (this *Screen) GetFrom() string {
+	if this.Reject != nil {
+		return this.Reject.From
+	}
+
+	return ""
+}
+
+// Get client ip
+func (this *Screen) GetFromIp() (v string) {
+	if this.Client != nil {
+		v = this.Client.GetIp()
+	}
+	return v
+}
+
+// Postscreen client is not authenticated
+func (this *Screen) GetSaslUser() string {
+	return ""
+}
+
+// Postscreen connection is not local submission
+func (this *Screen) GetUid() string {
+	return ""
+}
+
+// Return time value of the connection
+func (this *Screen) GetTime() (t time.Time) {
+	if this.Client != nil {
+		t = this.Client.At
+	}
+	return t
+}
+
+// Bot behaviour, blacklisted, DNSBL listed or rejected client counts
+// as one spam victim
+func (this *Screen) GetSpamScore() uint {
+	if len(this.Violations) > 0 || this.Reject != nil || this.Rank > 0 || len(this.Dnsbl) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// Get DNSBL rank
+func (this *Screen) GetSpamHits() float64 {
+	return float64(this.Rank)
+}
+
+// Connection does not have threshold
+func (this *Screen) GetSpamRequired() float64 {
+	return 0
+}
+
+// Get comma separated violations and listing domains
+func (this *Screen) GetSpamRules() string {
+	return strings.Join(append(append([]string{}, this.Violations...), this.Dnsbl...), ",")
+}
+
+// Connection does not have viruses
+func (this *Screen) GetViruses() string {
+	return ""
+}
+
+// Connection does not have viruses
+func (this *Screen) IsInfected() bool {
+	return false
+}
+
+// Get rejected recipient
+func (this *Screen) GetRecipients() []*Recipient {
+	if this.Reject != nil {
+		return this.Reject.GetRecipients()
+	}
+
+	return nil
+}
+
+// Get rejected recipient address
+func (this *Screen) GetTo() string {
+	if this.Reject != nil {
+		return this.Reject.To
+	}
+
+	return ""
+}
@@ -2,7 +2,30 @@ package filter
 
 import (
 	"regexp"
+	"strconv"
 	"strings"
+	"time"
+)
+
+// Amavis content categories
+const (
+	CategoryVirus              = "INFECTED"
+	CategoryBanned             = "BANNED"
+	CategoryUnchecked          = "UNCHECKED"
+	CategoryUncheckedEncrypted = "UNCHECKED-ENCRYPTED"
+	CategorySpam               = "SPAM"
+	CategorySpammy             = "SPAMMY"
+	CategoryBadHeader          = "BAD-HEADER"
+	CategoryOversized          = "OVERSIZED"
+	CategoryMtaBlocked         = "MTA-BLOCKED"
+	CategoryClean              = "CLEAN"
+	CategoryOther              = "OTHER"
+)
+
+// Amavis actions
+const (
+	ActionPassed  = "passed"
+	ActionBlocked = "blocked"
 )
 
 type Spam struct {
@@ -10,51 +33,113 @@ type Spam struct {
 	QueueId,
 	QueuedAs string
 	Score uint
+
+	// Scanner content category, action and action tags
+	Category   string
+	Action     string
+	ActionTags []string
+
+	// Scanner score details
+	Hits     float64
+	Required float64
+	Rules    []string
+
+	// Scanner name and found viruses
+	Scanner string
+	Viruses []string
+
+	// Log time of the verdict
+	at time.Time
 }
 
-// Exemain log line and found if there is spam information
-func NewSpam(str string) (sp *Spam, err error) {
-	if sp, err = getSpamd(str); err != nil {
-		if err != ErrorStrFormatNotSupported {
-			return
+// Content categories which count toward the spam score
+var spamCategories = map[string]bool{
+	CategorySpam:   true,
+	CategorySpammy: true,
+	CategoryBanned: true,
+}
+
+// Set content categories which count toward the spam score
+func SetSpamCategories(v []string) {
+	spamCategories = make(map[string]bool)
+
+	for _, c := range v {
+		if c = strings.ToUpper(strings.TrimSpace(c)); c != "" {
+			spamCategories[c] = true
 		}
-		// Reset error
-		err = nil
 	}
+}
+
+// Check if content category counts toward the spam score
+func IsSpamCategory(c string) bool {
+	return spamCategories[strings.ToUpper(c)]
+}
 
-	// Do not check amavis if spamd was found
-	if sp == nil {
-		if sp, err = getAmavisd(str); err != nil {
+// Spam scanners log parsers in the check order
+var spamParsers = []struct {
+	name string
+	fn   func(str string) (*Spam, error)
+}{
+	{"spamd", getSpamd},
+	{"amavis", getAmavisd},
+	{"rspamd", getRspamd},
+	{"clamav-milter", getClamavMilter},
+	{"clamd", getClamd},
+}
+
+// Exemain log line and found if there is spam information
+func NewSpam(str string) (sp *Spam, err error) {
+	for _, p := range spamParsers {
+		if sp, err = p.fn(str); err != nil {
 			if err != ErrorStrFormatNotSupported {
-				return
+				return nil, err
 			}
 			// Reset error
 			err = nil
 		}
+
+		// Do not check others if scanner was found
+		if sp != nil {
+			sp.at, _ = getTime(str)
+
+			break
+		}
 	}
 
 	return
 }
 
+// Check if verdict can be linked to the mail thread
+func (this *Spam) HasId() bool {
+	return this.MsgId != "" || this.QueueId != "" || this.QueuedAs != ""
+}
+
 // Check if string is spamd message
 func getSpamd(str string) (s *Spam, err error) {
 	var (
 		res []string
 	)
 
-	if res = spamdRe.FindStringSubmatch(str); len(res) < 5 {
+	if res = spamdRe.FindStringSubmatch(str); len(res) < 6 {
 		return nil, ErrorStrFormatNotSupported
 	}
 
 	s = &Spam{
-		Score: 0,
+		Score:   0,
+		Rules:   splitRules(res[4]),
+		Scanner: "spamd",
 	}
 
 	if strings.Contains(strings.ToLower(res[2]), "y") {
 		s.Score++
 	}
 
-	s.MsgId = res[4]
+	s.Hits, _ = strconv.ParseFloat(res[3], 64)
+	s.MsgId = res[5]
+
+	if v := spamdRequiredRe.FindStringSubmatch(str); len(v) > 1 {
+		s.Required, _ = strconv.ParseFloat(v[1], 64)
+	}
 
 	return
 }
@@ -63,23 +148,47 @@ func getSpamd(str string) (s *Spam, err error) {
 func getAmavisd(str string) (s *Spam, err error) {
 	var (
 		res []string
+		msg string
 	)
 
-	if res = amavisdRe.FindStringSubmatch(str); len(res) < 5 {
+	if res = amavisdRe.FindStringSubmatch(str); len(res) < 8 {
 		return nil, ErrorStrFormatNotSupported
 	}
 
-	// Convert to upper
-	res[2] = strings.ToUpper(res[2])
-
 	s = &Spam{
-		Score: 0,
+		Score:      0,
+		Category:   strings.ToUpper(res[3]),
+		Action:     strings.ToLower(res[2]),
+		ActionTags: make([]string, 0),
+		Scanner:    "amavis",
+	}
+
+	// Virus names are in the category details
+	if s.Category == CategoryVirus {
+		s.Viruses = splitRules(res[4])
+	}
+
+	for _, v := range strings.Split(res[5], ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			s.ActionTags = append(s.ActionTags, v)
+		}
 	}
 
-	s.MsgId = getMessageId(res[4])
+	// Recipients and statistics follow the sender
+	msg = res[7]
+
+	s.MsgId = getMessageId(msg)
+
+	if v := amavisHitsRe.FindStringSubmatch(msg); len(v) > 1 {
+		s.Hits, _ = strconv.ParseFloat(v[1], 64)
+	}
+
+	if v := amavisTestsRe.FindStringSubmatch(msg); len(v) > 1 {
+		s.Rules = splitRules(v[1])
+	}
 
 	// Pick up queues values
-	if q := amavisQueueRe.FindAllStringSubmatch(res[4], -1); len(q) > 0 {
+	if q := amavisQueueRe.FindAllStringSubmatch(msg, -1); len(q) > 0 {
 		for _, val := range q {
 			if len(val) < 3 {
 				continue
@@ -96,12 +205,11 @@ func getAmavisd(str string) (s *Spam, err error) {
 		}
 	}
 
-	if !strings.HasPrefix(res[2], "SPAM") &&
-		!strings.HasPrefix(res[2], "BANN") {
+	if !IsSpamCategory(s.Category) {
 		return
 	}
 
-	if res = amavisEmlRe.FindStringSubmatch(res[4]); len(res) > 0 {
+	if res = amavisEmlRe.FindStringSubmatch(msg); len(res) > 0 {
 		emls := strings.Split(res[0], ",")
 
 		for _, i := range emls {
@@ -119,3 +227,127 @@ func getAmavisd(str string) (s *Spam, err error) {
 
 	return
 }
+
+// Check if string is rspamd message
+func getRspamd(str string) (s *Spam, err error) {
+	var (
+		res []string
+		msg string
+	)
+
+	if res = rspamdRe.FindStringSubmatch(str); len(res) < 2 {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	msg = res[1]
+
+	if res = rspamdResultRe.FindStringSubmatch(msg); len(res) < 6 {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	s = &Spam{
+		Score:   0,
+		Action:  strings.ToLower(res[2]),
+		Rules:   make([]string, 0),
+		Scanner: "rspamd",
+	}
+
+	s.Hits, _ = strconv.ParseFloat(res[3], 64)
+	s.Required, _ = strconv.ParseFloat(res[4], 64)
+
+	// Symbols options may contain any text
+	for _, r := range rspamdSymbolRe.FindAllStringSubmatch(rspamdOptsRe.ReplaceAllString(res[5], ""), -1) {
+		s.Rules = append(s.Rules, r[1])
+	}
+
+	if v := rspamdIdRe.FindStringSubmatch(msg); len(v) > 1 && v[1] != "undef" {
+		s.MsgId = v[1]
+	}
+
+	if v := rspamdQidRe.FindStringSubmatch(msg); len(v) > 1 && v[1] != "undef" {
+		s.QueueId = v[1]
+	}
+
+	switch s.Action {
+	case "reject", "add header", "rewrite subject":
+
+	default:
+		if res[1] != "T" {
+			return
+		}
+	}
+
+	// Each recipient is a spam victim
+	if v := rspamdRcptRe.FindStringSubmatch(msg); len(v) > 1 {
+		s.Score = uint(strings.Count(v[1], "<"))
+	}
+
+	if s.Score == 0 {
+		s.Score = 1
+	}
+
+	return
+}
+
+// Split comma separated rules list, rule score is dropped
+func splitRules(str string) (v []string) {
+	v = make([]string, 0)
+
+	for _, r := range strings.Split(str, ",") {
+		if i := strings.IndexAny(r, "=("); i > -1 {
+			r = r[:i]
+		}
+
+		if r = strings.TrimSpace(r); r != "" {
+			v = append(v, r)
+		}
+	}
+
+	return
+}
+
+// Check if string is clamav-milter infected message
+func getClamavMilter(str string) (s *Spam, err error) {
+	var (
+		res []string
+	)
+
+	if res = clamavMilterRe.FindStringSubmatch(str); len(res) < 4 {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	s = &Spam{
+		Score:    0,
+		QueueId:  res[1],
+		Category: CategoryVirus,
+		Scanner:  "clamav-milter",
+		Viruses:  splitRules(res[3]),
+	}
+
+	if v := clamavMidRe.FindStringSubmatch(res[2]); len(v) > 1 {
+		s.MsgId = v[1]
+	}
+
+	return
+}
+
+// Check if string is clamd found message, clamd does not know
+// the mail thread so message can not be linked
+func getClamd(str string) (s *Spam, err error) {
+	var (
+		res []string
+	)
+
+	if res = clamdRe.FindStringSubmatch(str); len(res) < 3 {
+		return nil, ErrorStrFormatNotSupported
+	}
+
+	s = &Spam{
+		Score:    0,
+		Category: CategoryVirus,
+		Scanner:  "clamd",
+		Viruses:  []string{res[2]},
+	}
+
+	return
+}
@@ -0,0 +1,292 @@
+package filter
+
+import (
+	"bytes"
+	"encoding/gob"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// State file format version, increase on incompatible storage changes
+const StateVersion = 2
+
+var (
+	ErrorStateVersion = errors.New("State file version is not supported")
+)
+
+// Log file position which storage state corresponds to
+type Checkpoint struct {
+	File  string
+	Inode uint64
+	// Offset after the last processed line, its hash and length
+	Offset int64
+	Hash   uint64
+	Length int
+}
+
+// State file header
+type stateHeader struct {
+	Name    string
+	Version int
+}
+
+// Mail thread with links
+type stateThread struct {
+	Thread *MailThread
+
+	ChildId,
+	ParentId,
+	BounceId,
+	BounceOf string
+	SpamScans   uint
+	Expired     bool
+	Backscatter bool
+	Seen        time.Time
+	Closed      time.Time
+}
+
+// Verdict waiting for its thread
+type stateSpam struct {
+	Spam *Spam
+	At   time.Time
+}
+
+// In-flight storage data
+type storageState struct {
+	Threads     []*stateThread
+	Pending     []*stateSpam
+	Parents     map[string]string
+	Now         time.Time
+	Counters    Counters
+	Checkpoints []Checkpoint
+}
+
+// Write in-flight threads, pending verdicts, links and log positions
+func (this *Storage) Save(w io.Writer) (err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.save(w)
+}
+
+// Pass state to the function with storage locked, so the function
+// is ordered with callbacks of the completed threads
+func (this *Storage) Snapshot(fn func(state []byte)) (err error) {
+	var (
+		buf bytes.Buffer
+	)
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if err = this.save(&buf); err != nil {
+		return err
+	}
+
+	fn(buf.Bytes())
+
+	return nil
+}
+
+func (this *Storage) save(w io.Writer) (err error) {
+	var (
+		enc   = gob.NewEncoder(w)
+		state = &storageState{}
+	)
+
+	this.data.each(func(m *MailThread) {
+		state.Threads = append(state.Threads, &stateThread{
+			Thread:      m,
+			ChildId:     m.childId,
+			ParentId:    m.parentId,
+			BounceId:    m.bounceId,
+			BounceOf:    m.bounceOf,
+			SpamScans:   m.spamScans,
+			Expired:     m.expired,
+			Backscatter: m.backscatter,
+			Seen:        m.seen,
+			Closed:      m.closed,
+		})
+	})
+
+	for _, p := range this.pending {
+		state.Pending = append(state.Pending, &stateSpam{
+			Spam: p.sp,
+			At:   p.at,
+		})
+	}
+
+	state.Parents = this.parents
+	state.Now = this.now
+	state.Counters = this.counters
+
+	for _, v := range this.positions {
+		state.Checkpoints = append(state.Checkpoints, v)
+	}
+
+	if err = enc.Encode(&stateHeader{Name: "postlog-sa", Version: StateVersion}); err != nil {
+		return err
+	}
+
+	return enc.Encode(state)
+}
+
+// Read state written by Save, stored threads are kept
+func (this *Storage) Load(r io.Reader) (err error) {
+	var (
+		dec    = gob.NewDecoder(r)
+		header = &stateHeader{}
+		state  = &storageState{}
+	)
+
+	if err = dec.Decode(header); err != nil || header.Version != StateVersion {
+		return ErrorStateVersion
+	}
+
+	if err = dec.Decode(state); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// The least recently seen thread goes to the back of the list
+	sort.SliceStable(state.Threads, func(i, j int) bool {
+		return state.Threads[i].Seen.Before(state.Threads[j].Seen)
+	})
+
+	for _, v := range state.Threads {
+		m := v.Thread
+
+		if m == nil || m.Id == "" || this.data.get(m.Instance, m.Id) != nil {
+			continue
+		}
+
+		m.childId = v.ChildId
+		m.parentId = v.ParentId
+		m.bounceId = v.BounceId
+		m.bounceOf = v.BounceOf
+		m.spamScans = v.SpamScans
+		m.expired = v.Expired
+		m.backscatter = v.Backscatter
+		m.closed = v.Closed
+
+		this.data.put(m)
+		this.index(m)
+		this.touch(m, v.Seen)
+
+		if !m.closed.IsZero() {
+			this.closing = append(this.closing, m)
+		}
+	}
+
+	// Removed threads are completed in the order of removal
+	sort.SliceStable(this.closing, func(i, j int) bool {
+		return this.closing[i].closed.Before(this.closing[j].closed)
+	})
+
+	for child, parent := range state.Parents {
+		if _, ok := this.parents[child]; !ok {
+			this.parents[child] = parent
+		}
+	}
+
+	for _, p := range state.Pending {
+		if p.Spam != nil {
+			this.pending = append(this.pending, &pendingSpam{sp: p.Spam, at: p.At})
+		}
+	}
+
+	if state.Now.After(this.now) {
+		this.now = state.Now
+	}
+
+	this.counters = state.Counters
+
+	for _, v := range state.Checkpoints {
+		this.positions[v.File] = v
+	}
+
+	return nil
+}
+
+// Get log positions restored from the state
+func (this *Storage) GetCheckpoints() (v []Checkpoint) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	for _, p := range this.positions {
+		v = append(v, p)
+	}
+
+	return
+}
+
+// Write state to the file, file is replaced after data was written
+func (this *Storage) SaveFile(name string) (err error) {
+	var (
+		buf bytes.Buffer
+	)
+
+	if err = this.Save(&buf); err != nil {
+		return err
+	}
+
+	return WriteStateFile(name, buf.Bytes())
+}
+
+// Write state taken with Snapshot to the file, file is replaced
+// after data was written
+func WriteStateFile(name string, state []byte) (err error) {
+	var (
+		f *os.File
+	)
+
+	if f, err = ioutil.TempFile(filepath.Dir(name), filepath.Base(name)+".*"); err != nil {
+		return err
+	}
+
+	defer os.Remove(f.Name())
+
+	if _, err = f.Write(state); err != nil {
+		f.Close()
+
+		return err
+	}
+
+	if err = f.Close(); err != nil {
+		return err
+	}
+
+	return os.Rename(f.Name(), name)
+}
+
+// Read state from the file, missing file is not an error. File is kept
+// as it matches its log checkpoint, incompatible file is removed
+func (this *Storage) LoadFile(name string) (err error) {
+	var (
+		f *os.File
+	)
+
+	if f, err = os.Open(name); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+
+		return err
+	}
+
+	err = this.Load(f)
+	f.Close()
+
+	if err == ErrorStateVersion {
+		os.Remove(name)
+	}
+
+	return err
+}
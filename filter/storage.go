@@ -1,28 +1,125 @@
 package filter
 
 import (
+	"container/list"
 	"errors"
+	"strings"
+	"sync"
+	"time"
 )
 
 var (
 	ErrorStrFormatNotSupported = errors.New("String format is not supported")
 	ErrorStorageItemExists     = errors.New("Item with same id exists")
 	ErrorUnknownSpamItem       = errors.New("Unknown spam entry")
+	ErrorAmbiguousSpamItem     = errors.New("Spam entry matches several mail threads")
 	ErrorItemEmptyId           = errors.New("Item Id field is empty value")
 	ErrorItemWrongId           = errors.New("Item Id is not same")
 )
 
+// Storage statistics
+type Counters struct {
+	// Completed mail threads
+	Threads uint
+	// Notifications created by bounce daemon
+	Bounces uint
+	// Notifications sent to the forged sender of spam
+	Backscatter uint
+	// Incomplete threads removed after time to live, by threads limit or on flush
+	Expired,
+	Evicted,
+	Flushed uint
+	// Spam scanner verdicts
+	Verdicts uint
+	// Verdicts buffered before their thread, applied later and expired unmatched
+	Pending,
+	Matched,
+	Unmatched uint
+}
+
+// Spam verdict waiting for its thread
+type pendingSpam struct {
+	sp *Spam
+	at time.Time
+}
+
+// The last log time of the line source and the latest log time
+// when the source delivered its last line
+type sourceMark struct {
+	at   time.Time
+	seen time.Time
+}
+
+// Storage methods are safe for concurrent use, callbacks are called
+// with storage locked and must not call storage methods. Threads are
+// sharded by queue id, each shard has its own lock, so threads are got
+// and counted without the storage lock. Links across queue ids (parent
+// and child, bounce, message id and client indexes, pending verdicts)
+// and the expiry lists are guarded by the storage lock. Lock order is
+// the storage lock, then one shard lock at a time: shard lock is never
+// held while the storage lock or the other shard lock is taken.
+// Lines are applied in the log order by the one pipeline goroutine
 type Storage struct {
+	mu sync.Mutex
+
 	threadDone func(v ThreadFace, args ...interface{}) error
+	eventDone  func(v ThreadFace, args ...interface{}) error
 	keepData   bool
-	data       map[string]*MailThread
+	data       shardMap
+	screens    map[string]*Screen
+	counters   Counters
+
+	// Secondary indexes: message id, client ip and child id to parent key
+	msgIds  threadIndex
+	clients threadIndex
+	parents map[string]string
+
+	// Threads in the last seen order, the latest log time and limits
+	lru        *list.List
+	elems      map[*MailThread]*list.Element
+	now        time.Time
+	swept      time.Time
+	ttl        time.Duration
+	maxThreads int
+
+	// Postscreen connections without final action are completed after window
+	screenWindow time.Duration
+
+	// Verdicts waiting for their thread within the window
+	pending       []*pendingSpam
+	pendingWindow time.Duration
+
+	// Removed threads waiting for verdicts from the other log within the window
+	closing        []*MailThread
+	completeWindow time.Duration
+
+	// The last log time by source and the least of them, sources are read
+	// with the different progress and windows wait for the source behind
+	sources    map[string]*sourceMark
+	low        time.Time
+	sourceIdle time.Duration
+
+	// Log position of the last emitted line by file
+	positions map[string]Checkpoint
 }
 
 // Craete storage instance
 func NewStorage() (s *Storage) {
 	s = &Storage{
 		threadDone: func(v ThreadFace, args ...interface{}) error { return nil },
-		data:       make(map[string]*MailThread),
+		eventDone:  func(v ThreadFace, args ...interface{}) error { return nil },
+		data:       newShardMap(threadShards),
+		screens:    make(map[string]*Screen),
+		msgIds:     make(threadIndex),
+		clients:    make(threadIndex),
+		parents:    make(map[string]string),
+		lru:        list.New(),
+		elems:      make(map[*MailThread]*list.Element),
+		positions:  make(map[string]Checkpoint),
+		sources:    make(map[string]*sourceMark),
+
+		screenWindow: 10 * time.Minute,
+		sourceIdle:   5 * time.Minute,
 	}
 
 	return
@@ -30,120 +127,839 @@ func NewStorage() (s *Storage) {
 
 // Set keepData flag
 func (this *Storage) SetKeepData(v bool) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	this.keepData = v
 }
 
+// Set thread time to live by the log time since the last thread line,
+// zero value disables expiry
+func (this *Storage) SetTTL(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.ttl = d
+}
+
+// Set maximum threads count, the least recently seen thread is evicted
+// on overflow, zero value disables limit
+func (this *Storage) SetMaxThreads(n int) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.maxThreads = n
+}
+
+// Set window of the log time to keep verdict which arrived before
+// its thread, zero value disables buffer
+func (this *Storage) SetPendingWindow(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.pendingWindow = d
+}
+
+// Set window of the log time to keep removed thread for verdict which
+// arrives later from the other log, zero value completes thread at once
+func (this *Storage) SetCompleteWindow(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.completeWindow = d
+}
+
+// Set window of the log time to complete postscreen connection without
+// final action, zero value keeps connections until flush
+func (this *Storage) SetScreenWindow(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.screenWindow = d
+}
+
+// Set log time of the other sources after which the source without
+// lines is forgotten and does not hold the windows, zero value keeps
+// the source until restart
+func (this *Storage) SetSourceIdle(d time.Duration) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.sourceIdle = d
+}
+
 // Set call back func on main thread information is fill full
 func (this *Storage) SetThreadDoneCb(fn func(v ThreadFace, args ...interface{}) (err error)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
 	this.threadDone = fn
 }
 
-// Get data storage length
+// Set call back func on event without mail thread, e.g. reject
+func (this *Storage) SetEventCb(fn func(v ThreadFace, args ...interface{}) (err error)) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.eventDone = fn
+}
+
+// Get data storage length, shards are counted one by one
 func (this *Storage) Len() int {
-	return len(this.data)
+	return this.data.len()
 }
 
-// Get thread object from data storage
-func (this *Storage) Get(id string) (m *MailThread) {
-	var ok bool = false
+// Get thread object from data storage by queue id or instance/queue id
+// key, thread without instance is found by queue id if it is the only one.
+// Only the shard of the queue id is locked
+func (this *Storage) Get(key string) (m *MailThread) {
+	return this.data.find(splitKey(key))
+}
 
-	if m, ok = this.data[id]; !ok {
+// Get thread by the key
+func (this *Storage) get(key string) *MailThread {
+	if key == "" {
 		return nil
 	}
 
-	return m
+	return this.data.get(splitKey(key))
+}
+
+// Get stored thread of the line: line without instance belongs to the only
+// thread with its queue id, thread without instance gets the instance
+func (this *Storage) lookup(m *MailThread) (item *MailThread) {
+	if item = this.data.get(m.Instance, m.Id); item != nil {
+		return item
+	}
+
+	if m.Instance == "" {
+		return this.data.find("", m.Id)
+	}
+
+	if item = this.data.get("", m.Id); item != nil {
+		this.rekey(item, m.Instance)
+	}
+
+	return item
+}
+
+// Move thread without instance to the instance and update its links
+func (this *Storage) rekey(m *MailThread, instance string) {
+	old := m.key()
+
+	this.data.remove(m)
+	m.Instance = instance
+	this.data.put(m)
+
+	if m.childId != "" && this.parents[m.childId] == old {
+		this.parents[m.childId] = m.key()
+	}
+
+	if child := this.data.find(instance, m.childId); child != nil && child.parentId == old {
+		child.parentId = m.key()
+	}
 }
 
 // Add new items to the storage
 func (this *Storage) Set(m *MailThread) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.set(m)
+}
+
+// Store thread line, stored thread is returned
+func (this *Storage) set(m *MailThread) (item *MailThread) {
 	var (
-		item,
 		child *MailThread
-		ok bool
 	)
 
 	if m == nil || m.GetId() == "" {
-		return
+		return nil
 	}
 
-	if item, ok = this.data[m.Id]; ok {
+	if item = this.lookup(m); item != nil {
 		item.apply(m)
 	} else {
-		this.data[m.Id] = m
+		this.data.put(m)
 		item = m
+
+		// Parent thread logged "queued as" before child was stored
+		if key, ok := this.parents[item.Id]; ok {
+			item.parentId = key
+		}
 	}
 
+	this.index(item)
+	this.touch(item, m.seen)
+	this.applyPending(item)
+
 	if item.childId != "" {
-		if child = this.Get(item.childId); child != nil {
-			child.parentId = item.Id
+		this.parents[item.childId] = item.key()
+
+		// Child of the content filter may be queued by the other instance
+		if child = this.data.find(item.Instance, item.childId); child != nil {
+			child.parentId = item.key()
 		}
 	}
+
+	// Notification thread may exist already, cleanup logs it first
+	if m.bounce != nil {
+		bounce := m.bounce
+		m.bounce = nil
+
+		this.set(bounce)
+	}
+
+	return item
+}
+
+// Apply buffered verdicts which belong to the thread
+func (this *Storage) applyPending(m *MailThread) {
+	if len(this.pending) == 0 {
+		return
+	}
+
+	i := 0
+	for _, p := range this.pending {
+		if p.matches(m) && this.setSpamStat(p.sp) == nil {
+			this.counters.Matched++
+
+			continue
+		}
+
+		this.pending[i] = p
+		i++
+	}
+
+	for j := i; j < len(this.pending); j++ {
+		this.pending[j] = nil
+	}
+	this.pending = this.pending[:i]
+}
+
+// Drop buffered verdicts out of window
+func (this *Storage) expirePending() {
+	now := this.windowTime()
+
+	i := 0
+	for _, p := range this.pending {
+		if now.Sub(p.at) > this.pendingWindow {
+			this.counters.Unmatched++
+
+			continue
+		}
+
+		this.pending[i] = p
+		i++
+	}
+
+	for j := i; j < len(this.pending); j++ {
+		this.pending[j] = nil
+	}
+	this.pending = this.pending[:i]
+}
+
+// Check if verdict may belong to the thread
+func (this *pendingSpam) matches(m *MailThread) bool {
+	id := strings.ToUpper(m.Id)
+
+	if this.sp.QueuedAs != "" || this.sp.QueueId != "" {
+		return strings.ToUpper(this.sp.QueuedAs) == id || strings.ToUpper(this.sp.QueueId) == id
+	}
+
+	return m.MsgId != "" && this.sp.MsgId == m.MsgId
+}
+
+// Keep the log time of the line source, source is forgotten when
+// the latest log time moved sourceIdle past its last line
+func (this *Storage) mark(source string, t time.Time) {
+	this.advance(t)
+
+	if s, ok := this.sources[source]; ok {
+		s.seen = this.now
+
+		if t.After(s.at) {
+			s.at = t
+		}
+	} else if !t.IsZero() {
+		this.sources[source] = &sourceMark{at: t, seen: this.now}
+	}
+
+	this.low = time.Time{}
+
+	for name, s := range this.sources {
+		if this.sourceIdle > 0 && this.now.Sub(s.seen) > this.sourceIdle {
+			delete(this.sources, name)
+
+			continue
+		}
+
+		if this.low.IsZero() || s.at.Before(this.low) {
+			this.low = s.at
+		}
+	}
+}
+
+// Get log time of the windows and time to live: the least time of
+// the read sources or the latest log time if sources are not tracked
+func (this *Storage) windowTime() time.Time {
+	if this.low.IsZero() {
+		return this.now
+	}
+
+	return this.low
+}
+
+// Move the latest log time forward
+func (this *Storage) advance(t time.Time) {
+	if t.After(this.now) {
+		this.now = t
+	}
+}
+
+// Move thread to the front of the last seen list
+func (this *Storage) touch(m *MailThread, t time.Time) {
+	this.advance(t)
+
+	// Line without time is seen now
+	if t.IsZero() {
+		t = this.now
+	}
+
+	if t.After(m.seen) {
+		m.seen = t
+	}
+
+	if e, ok := this.elems[m]; ok {
+		this.lru.MoveToFront(e)
+	} else {
+		this.elems[m] = this.lru.PushFront(m)
+	}
+}
+
+// Complete threads which are not seen within time to live
+// and the least recently seen threads over the limit
+func (this *Storage) Expire(args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.expire(args...)
+}
+
+func (this *Storage) expire(args ...interface{}) {
+	now := this.windowTime()
+
+	if len(this.pending) > 0 {
+		this.expirePending()
+	}
+
+	if len(this.closing) > 0 {
+		this.expireClosing(false, args...)
+	}
+
+	for e := this.lru.Back(); e != nil; e = this.lru.Back() {
+		m := e.Value.(*MailThread)
+
+		switch {
+		case this.maxThreads > 0 && this.lru.Len() > this.maxThreads:
+			this.counters.Evicted++
+
+		case this.ttl > 0 && now.Sub(m.seen) > this.ttl:
+			this.counters.Expired++
+
+		default:
+			this.expireScreens(args...)
+
+			return
+		}
+
+		this.expireThread(m, args...)
+	}
+
+	this.expireScreens(args...)
+}
+
+// Complete all threads and postscreen connections at the end of log,
+// verdicts waiting for their threads are dropped
+func (this *Storage) Flush(args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.counters.Unmatched += uint(len(this.pending))
+	this.pending = nil
+
+	this.expireClosing(true, args...)
+
+	for e := this.lru.Back(); e != nil; e = this.lru.Back() {
+		this.counters.Flushed++
+
+		this.expireThread(e.Value.(*MailThread), args...)
+	}
+
+	for ip, item := range this.screens {
+		delete(this.screens, ip)
+
+		this.eventDone(item, args...)
+	}
+}
+
+// Complete thread which was not removed from the queue
+func (this *Storage) expireThread(m *MailThread, args ...interface{}) {
+	m.Incomplete = true
+
+	if child := this.data.find(m.Instance, m.childId); child != nil && child != m {
+		m.mergeSpam(child)
+
+		if len(child.Recipients) > 0 {
+			m.Recipients = child.Recipients
+		}
+
+		this.destroy(child)
+	}
+
+	this.markBackscatter(m, m)
+	this.complete(m, args...)
+	this.destroy(m)
+}
+
+// Pass postscreen connections without final action to the callback,
+// connections are checked once per screen window
+func (this *Storage) expireScreens(args ...interface{}) {
+	now := this.windowTime()
+
+	if this.screenWindow == 0 || now.Sub(this.swept) < this.screenWindow {
+		return
+	}
+
+	this.swept = now
+
+	for ip, item := range this.screens {
+		if now.Sub(item.GetTime()) > this.screenWindow {
+			delete(this.screens, ip)
+
+			this.eventDone(item, args...)
+		}
+	}
+}
+
+// Remove thread from the last seen list
+func (this *Storage) untrack(m *MailThread) {
+	if e, ok := this.elems[m]; ok {
+		this.lru.Remove(e)
+		delete(this.elems, m)
+	}
+}
+
+// Update secondary indexes with thread values
+func (this *Storage) index(m *MailThread) {
+	this.msgIds.add(m.MsgId, m)
+
+	if m.Client != nil {
+		this.clients.add(m.Client.GetIp(), m)
+	}
+}
+
+// Get threads by message id
+func (this *Storage) GetByMessageId(id string) []*MailThread {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.msgIds.get(id)
+}
+
+// Get threads by client ip
+func (this *Storage) GetByIp(ip string) []*MailThread {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.clients.get(normalizeIp(ip))
 }
 
 // Test each thread to run callback function
 func (this *Storage) ThreadDone(m *MailThread, args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if m != nil {
+		this.checkDone(this.data.find(m.Instance, m.Id), args...)
+	}
+}
+
+// Complete stored thread if it was removed with its child
+func (this *Storage) checkDone(item *MailThread, args ...interface{}) {
 	var (
-		item,
 		child,
 		parent *MailThread
 	)
 
-	if m == nil || m.GetId() == "" {
+	if item == nil {
 		return
 	}
 
-	item = this.Get(m.GetId())
-
-	// Get child threa
-	if child = this.Get(item.childId); child == nil {
-		child = this.Get(item.GetId())
+	// Get child thread
+	if child = this.data.find(item.Instance, item.childId); child == nil {
+		child = item
 	}
 
 	// Get parent thread
-	if parent = this.Get(item.parentId); parent == nil {
-		parent = this.Get(item.GetId())
+	if parent = this.get(item.parentId); parent == nil {
+		parent = item
+	}
+
+	if parent.Removed == false || (parent != child && parent.Removed != child.Removed) {
+		return
+	}
+
+	if this.completeWindow > 0 {
+		if parent.closed.IsZero() {
+			// Thread is closed by the log time of the line
+			if parent.closed = item.seen; parent.closed.IsZero() {
+				parent.closed = this.windowTime()
+			}
+
+			this.closing = append(this.closing, parent)
+		}
+
+		return
+	}
+
+	this.finish(parent, child, args...)
+}
+
+// Complete removed thread with its child
+func (this *Storage) finish(parent, child *MailThread, args ...interface{}) {
+	if parent == child {
+		this.markBackscatter(parent, parent)
+		this.complete(parent, args...)
+		this.destroy(parent)
+
+		return
+	}
+
+	parent.mergeSpam(child)
+
+	// Child thread keeps the final delivery status
+	if len(child.Recipients) > 0 {
+		parent.Recipients = child.Recipients
+	}
+
+	this.markBackscatter(parent, parent, child)
+	this.complete(parent, args...)
+	this.destroy(parent)
+	this.destroy(child)
+}
+
+// Complete removed threads after the window, all threads are completed if force
+func (this *Storage) expireClosing(force bool, args ...interface{}) {
+	var (
+		i   int
+		now = this.windowTime()
+	)
+
+	for ; i < len(this.closing); i++ {
+		m := this.closing[i]
+
+		// Thread was completed by expiry
+		if _, ok := this.elems[m]; !ok {
+			continue
+		}
+
+		if !force && now.Sub(m.closed) < this.completeWindow {
+			break
+		}
+
+		child := this.data.find(m.Instance, m.childId)
+		if child == nil {
+			child = m
+		}
+
+		this.finish(m, child, args...)
+	}
+
+	for j := 0; j < i; j++ {
+		this.closing[j] = nil
+	}
+	this.closing = this.closing[i:]
+}
+
+// Mark notifications of the threads as backscatter if spam thread is m,
+// notification is queued by the instance of its thread
+func (this *Storage) markBackscatter(m *MailThread, threads ...*MailThread) {
+	if m.GetSpamScore() == 0 && !m.IsInfected() {
+		return
+	}
+
+	for _, t := range threads {
+		if t.bounceId == "" {
+			continue
+		}
+
+		if item := this.data.find(t.Instance, t.bounceId); item != nil {
+			item.backscatter = true
+		}
+	}
+}
+
+// Count completed thread and run callback
+func (this *Storage) complete(m *MailThread, args ...interface{}) {
+	this.counters.Threads++
+
+	if m.bounceOf != "" {
+		this.counters.Bounces++
+
+		if m.backscatter {
+			this.counters.Backscatter++
+		}
+	}
+
+	this.threadDone(m, args...)
+}
+
+// Get storage statistics
+func (this *Storage) GetCounters() Counters {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.counters
+}
+
+// Pass event without mail thread to the callback
+func (this *Storage) Event(v ThreadFace, args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.event(v, args...)
+}
+
+func (this *Storage) event(v ThreadFace, args ...interface{}) {
+	if v == nil {
+		return
+	}
+
+	this.eventDone(v, args...)
+}
+
+// Parse log line with the enabled parsers and emit result to the storage
+func (this *Storage) Parse(str string, args ...interface{}) (v interface{}, err error) {
+	if v, err = Parse(str); err != nil {
+		return nil, err
 	}
 
-	if parent.Removed == true {
-		if parent == child {
-			this.threadDone(parent, args...)
-			this.Destroy(parent.GetId())
-		} else {
-			if parent.Removed == child.Removed {
-				parent.SpamScore = child.SpamScore
+	return v, this.Emit(v, args...)
+}
+
+// Put parser result to the storage: mail thread is stored and checked,
+// reject is passed to the event callback, spam verdict is written to the thread
+func (this *Storage) Emit(v interface{}, args ...interface{}) (err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.emit(v, args...)
+}
+
+func (this *Storage) emit(v interface{}, args ...interface{}) (err error) {
+	switch v.(type) {
+	case *MailThread:
+		this.checkDone(this.set(v.(*MailThread)), args...)
+
+	case *Reject:
+		this.event(v.(*Reject), args...)
+
+	case *ScreenEvent:
+		this.screen(v.(*ScreenEvent), args...)
+
+	case *Spam:
+		this.counters.Verdicts++
+
+		// Verdict without ids can not be linked to the thread
+		if sp := v.(*Spam); sp.HasId() {
+			if err = this.setSpamStat(sp); err == ErrorUnknownSpamItem && this.pendingWindow > 0 {
+				// Verdict waits by its own log time
+				at := sp.at
+				if at.IsZero() {
+					at = this.windowTime()
+				}
 
-				this.threadDone(parent, args...)
-				this.Destroy(parent.GetId())
-				this.Destroy(child.GetId())
+				this.pending = append(this.pending, &pendingSpam{sp: sp, at: at})
+				this.counters.Pending++
+
+				err = nil
 			}
 		}
+
+	default:
+		err = ErrorStrFormatNotSupported
+	}
+
+	this.expire(args...)
+
+	return
+}
+
+// Emit parsed line and keep its log position with the same lock,
+// so the saved state matches the position. Line time moves its source mark
+func (this *Storage) emitLine(line *Line, at time.Time, v interface{}, err error, args ...interface{}) error {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.mark(line.Source, at)
+
+	if err == nil {
+		err = this.emit(v, args...)
 	}
+
+	if line.Pos.File != "" {
+		this.positions[line.Pos.File] = line.Pos
+	}
+
+	return err
+}
+
+// Aggregate postscreen events by client ip, connection is passed
+// to the event callback when postscreen finished it
+func (this *Storage) Screen(e *ScreenEvent, args ...interface{}) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.screen(e, args...)
 }
 
-// Write spam statistics to the mail thread
+func (this *Storage) screen(e *ScreenEvent, args ...interface{}) {
+	var (
+		item *Screen
+		ok   bool
+		ip   string
+	)
+
+	if e == nil || e.Client == nil {
+		return
+	}
+
+	ip = e.Client.GetIp()
+	this.advance(e.Client.At)
+
+	if item, ok = this.screens[ip]; !ok {
+		item = newScreen(e)
+		this.screens[ip] = item
+	}
+
+	item.apply(e)
+
+	if e.IsFinal() {
+		delete(this.screens, ip)
+
+		this.eventDone(item, args...)
+	}
+}
+
+// Get postscreen connection by client ip
+func (this *Storage) GetScreen(ip string) *Screen {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.screens[normalizeIp(ip)]
+}
+
+// Write spam statistics to the mail thread. Thread is found by the queue id
+// pair of content filter, message id is used if scanner does not log queue id
 func (this *Storage) SetSpamStat(sp *Spam) (err error) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.setSpamStat(sp)
+}
+
+func (this *Storage) setSpamStat(sp *Spam) (err error) {
+	var (
+		item *MailThread
+	)
+
 	if sp == nil {
 		return ErrorUnknownSpamItem
 	}
 
-	for _, item := range this.data {
-		if item.MsgId == sp.MsgId {
-			if sp.QueuedAs != "" && sp.QueuedAs != item.Id {
-				continue
-			}
+	// Reinjected thread, then scanned one
+	for _, id := range []string{sp.QueuedAs, sp.QueueId} {
+		if id == "" {
+			continue
+		}
 
-			item.SpamScore += sp.Score
+		// Content filter does not log the instance
+		if this.data.count(strings.ToUpper(id)) > 1 {
+			return ErrorAmbiguousSpamItem
+		}
+
+		if item = this.data.find("", strings.ToUpper(id)); item != nil {
+			item.setSpam(sp)
 
 			return
 		}
 	}
 
-	return ErrorUnknownSpamItem
+	// Queue ids of another host or expired thread, try message id
+	if sp.MsgId == "" {
+		return ErrorUnknownSpamItem
+	}
+
+	if item, err = this.getByMessageId(sp.MsgId); err != nil {
+		return err
+	}
+
+	item.setSpam(sp)
+
+	return
 }
 
-// Destroy mail thread
-func (this *Storage) Destroy(id string) {
-	if !this.keepData {
-		delete(this.data, id)
+// Find the only thread with message id, child thread of the content
+// filter is skipped if its parent has the same message id
+func (this *Storage) getByMessageId(id string) (m *MailThread, err error) {
+	for item := range this.msgIds[id] {
+		if p := this.get(item.parentId); p != nil && p.MsgId == id {
+			continue
+		}
+
+		if m != nil {
+			return nil, ErrorAmbiguousSpamItem
+		}
+
+		m = item
+	}
+
+	if m == nil {
+		return nil, ErrorUnknownSpamItem
+	}
+
+	return m, nil
+}
+
+// Destroy mail thread by queue id or instance/queue id key
+func (this *Storage) Destroy(key string) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if m := this.data.find(splitKey(key)); m != nil {
+		this.destroy(m)
+	}
+}
+
+func (this *Storage) destroy(m *MailThread) {
+	this.untrack(m)
+
+	if this.keepData {
+		return
+	}
+
+	this.msgIds.remove(m.MsgId, m)
+
+	if m.Client != nil {
+		this.clients.remove(m.Client.GetIp(), m)
 	}
+
+	if m.childId != "" && this.parents[m.childId] == m.key() {
+		delete(this.parents, m.childId)
+	}
+
+	delete(this.parents, m.Id)
+	this.data.remove(m)
 }
@@ -1,31 +1,65 @@
 package filter
 
 import (
+	"strings"
 	"time"
 )
 
 type MailThread struct {
 	Id       string
+	Instance string
 	MsgId    string
 	From     string
 	childId  string
 	parentId string
+	bounceId string
+	bounceOf string
+	// Notification thread placeholder
+	bounce *MailThread
 
-	SpamScore  uint
-	smtpStatus uint8
+	SpamScore    uint
+	SpamHits     float64
+	SpamRequired float64
+	SpamRules    []string
+	Viruses      []string
+	spamScans    uint
+	expired      bool
+	backscatter  bool
 
-	Client  *Client
-	Removed bool
+	Client     *Client
+	Uid        string
+	SaslMethod string
+	SaslUser   string
+	Recipients []*Recipient
+	Removed    bool
+	// Thread was completed without removed line
+	Incomplete bool
+	// Log time of the last thread line
+	seen time.Time
+	// Log time when removed thread was queued for completion
+	closed time.Time
 }
 
 type ThreadFace interface {
 	GetId() string
+	GetInstance() string
 	GetChildId() string
+	GetBounceId() string
+	GetBounceOf() string
 	GetMessageId() string
 	GetFrom() string
 	GetFromIp() string
+	GetSaslUser() string
+	GetUid() string
 	GetTime() time.Time
 	GetSpamScore() uint
+	GetSpamHits() float64
+	GetSpamRequired() float64
+	GetSpamRules() string
+	GetViruses() string
+	IsInfected() bool
+	GetRecipients() []*Recipient
+	GetTo() string
 }
 
 func NewMailThread(str string) (m *MailThread, err error) {
@@ -41,26 +75,45 @@ func NewMailThread(str string) (m *MailThread, err error) {
 
 	m = &MailThread{
 		Id:        id,
+		Instance:  getInstance(str),
 		From:      getFrom(str),
 		SpamScore: 0,
 		Removed:   IsRemoved(str),
 	}
 
 	m.Client = getClient(str)
+	m.seen, _ = getTime(str)
+	m.SaslMethod, m.SaslUser = getSasl(str)
+	m.Uid = getUid(str)
 
-	if ok, mid := IsPostfix(str, []string{"cleanup"}); ok && len(mid) > 4 {
+	if ok, mid := IsPostfix(str, cleanupServices); ok && len(mid) > 4 {
 		m.MsgId = getMessageId(mid[4])
 	}
 
-	if ok, mid := IsPostfix(str, []string{"smtp"}); ok && len(mid) > 4 {
+	if ok, mid := IsPostfix(str, relayServices); ok && len(mid) > 4 {
 		m.childId = getIdQueuedAs(mid[4])
+	}
+
+	if r := getRecipient(str); r != nil {
+		m.Recipients = []*Recipient{r}
+	}
 
-		switch getSmtpStatus(mid[4]) {
-			case "sent":
-				m.smtpStatus = 1
+	m.expired = isExpired(str)
+
+	// Notification is created for the thread, time is taken from the bounce line
+	if m.bounceId = getBounceId(str); m.bounceId != "" {
+		m.bounce = &MailThread{
+			Id:       m.bounceId,
+			Instance: m.Instance,
+			bounceOf: m.Id,
+			Client: &Client{
+				Name: localClient.Name,
+				IP:   localClient.IP,
+			},
+		}
 
-			case "deferred":
-				m.smtpStatus = 2
+		if t, err := getTime(str); err == nil {
+			m.bounce.Client.At = t
 		}
 	}
 
@@ -72,11 +125,41 @@ func (this *MailThread) GetId() string {
 	return this.Id
 }
 
+// Get storage key of the thread
+func (this *MailThread) key() string {
+	return threadKey(this.Instance, this.Id)
+}
+
+// Get postfix instance syslog_name
+func (this *MailThread) GetInstance() string {
+	return this.Instance
+}
+
 // Get child thread ID
 func (this *MailThread) GetChildId() string {
 	return this.childId
 }
 
+// Get queue id of the notification created for the thread
+func (this *MailThread) GetBounceId() string {
+	return this.bounceId
+}
+
+// Get queue id of the thread which notification is
+func (this *MailThread) GetBounceOf() string {
+	return this.bounceOf
+}
+
+// Check if thread was completed by expiry
+func (this *MailThread) IsIncomplete() bool {
+	return this.Incomplete
+}
+
+// Check if thread is notification to the sender of spam
+func (this *MailThread) IsBackscatter() bool {
+	return this.backscatter
+}
+
 // Get message id
 func (this *MailThread) GetMessageId() string {
 	return this.MsgId
@@ -90,11 +173,21 @@ func (this *MailThread) GetFrom() string {
 // Get client ip
 func (this *MailThread) GetFromIp() (v string) {
 	if this.Client != nil {
-		v = this.Client.IP
+		v = this.Client.GetIp()
 	}
 	return v
 }
 
+// Get authenticated client user name
+func (this *MailThread) GetSaslUser() string {
+	return this.SaslUser
+}
+
+// Get local user id of the mail submitted with sendmail command
+func (this *MailThread) GetUid() string {
+	return this.Uid
+}
+
 // Return time value when mail was accepted by server for the delivery
 func (this *MailThread) GetTime() (t time.Time) {
 	if this.Client != nil {
@@ -107,12 +200,122 @@ func (this *MailThread) GetSpamScore() uint {
 	return this.SpamScore
 }
 
+// Get spam scanner score
+func (this *MailThread) GetSpamHits() float64 {
+	return this.SpamHits
+}
+
+// Get spam scanner threshold
+func (this *MailThread) GetSpamRequired() float64 {
+	return this.SpamRequired
+}
+
+// Get comma separated spam rules list
+func (this *MailThread) GetSpamRules() string {
+	return strings.Join(this.SpamRules, ",")
+}
+
+// Add spam scanner verdict, the highest score is kept
+func (this *MailThread) setSpam(sp *Spam) {
+	this.SpamScore += sp.Score
+
+	if this.spamScans == 0 || sp.Hits > this.SpamHits {
+		this.SpamHits = sp.Hits
+		this.SpamRequired = sp.Required
+	}
+
+	this.SpamRules = appendUnique(this.SpamRules, sp.Rules)
+	this.Viruses = appendUnique(this.Viruses, sp.Viruses)
+	this.spamScans++
+}
+
+// Take child thread spam verdict
+func (this *MailThread) mergeSpam(m *MailThread) {
+	if m.spamScans == 0 {
+		return
+	}
+
+	if m.SpamScore > this.SpamScore {
+		this.SpamScore = m.SpamScore
+	}
+
+	if this.spamScans == 0 || m.SpamHits > this.SpamHits {
+		this.SpamHits = m.SpamHits
+		this.SpamRequired = m.SpamRequired
+	}
+
+	this.SpamRules = appendUnique(this.SpamRules, m.SpamRules)
+	this.Viruses = appendUnique(this.Viruses, m.Viruses)
+	this.spamScans += m.spamScans
+}
+
+// Get comma separated viruses list
+func (this *MailThread) GetViruses() string {
+	return strings.Join(this.Viruses, ",")
+}
+
+// Check if virus was found in the mail
+func (this *MailThread) IsInfected() bool {
+	return len(this.Viruses) > 0
+}
+
+// Add values which are not in the list
+func appendUnique(list []string, values []string) []string {
+	for _, r := range values {
+		found := false
+
+		for _, v := range list {
+			if v == r {
+				found = true
+				break
+			}
+		}
+
+		if !found {
+			list = append(list, r)
+		}
+	}
+
+	return list
+}
+
+// Get recipients with the delivery status
+func (this *MailThread) GetRecipients() []*Recipient {
+	return this.Recipients
+}
+
+// Get comma separated recipients list
+func (this *MailThread) GetTo() string {
+	var v = make([]string, 0, len(this.Recipients))
+
+	for _, r := range this.Recipients {
+		v = append(v, r.Address)
+	}
+
+	return strings.Join(v, ",")
+}
+
+// Get recipient by address
+func (this *MailThread) getRecipient(address string) *Recipient {
+	for _, r := range this.Recipients {
+		if r.Address == address {
+			return r
+		}
+	}
+
+	return nil
+}
+
 // Add new values to the object
 func (this *MailThread) apply(m *MailThread) error {
 	if this.Id != m.Id {
 		return ErrorItemWrongId
 	}
 
+	if this.Instance == "" && m.Instance != "" {
+		this.Instance = m.Instance
+	}
+
 	if this.From == "" && m.From != "" {
 		this.From = m.From
 	}
@@ -121,16 +324,47 @@ func (this *MailThread) apply(m *MailThread) error {
 		this.MsgId = m.MsgId
 	}
 
-	if this.Client == nil && m.Client != nil {
-		*this.Client = *m.Client
+	// Client without address has the line time only
+	if m.Client != nil && (this.Client == nil || (this.Client.IP == "" && m.Client.IP != "")) {
+		this.Client = m.Client
+	}
+
+	if this.Uid == "" && m.Uid != "" {
+		this.Uid = m.Uid
+	}
+
+	if this.SaslUser == "" && m.SaslUser != "" {
+		this.SaslMethod = m.SaslMethod
+		this.SaslUser = m.SaslUser
 	}
 
 	if this.childId == "" && m.childId != "" {
 		this.childId = m.childId
 	}
 
-	if this.smtpStatus == 0 && m.smtpStatus > 0 {
-		this.smtpStatus = m.smtpStatus
+	if this.bounceId == "" && m.bounceId != "" {
+		this.bounceId = m.bounceId
+	}
+
+	if this.bounceOf == "" && m.bounceOf != "" {
+		this.bounceOf = m.bounceOf
+	}
+
+	for _, r := range m.Recipients {
+		if v := this.getRecipient(r.Address); v != nil {
+			v.apply(r)
+		} else {
+			this.Recipients = append(this.Recipients, r)
+		}
+	}
+
+	// Deferred recipients were returned to sender
+	if m.expired {
+		for _, r := range this.Recipients {
+			if r.Status == StatusDeferred {
+				r.Status = StatusExpired
+			}
+		}
 	}
 
 	if !this.Removed && m.Removed {
@@ -0,0 +1,190 @@
+package filter
+
+import (
+	"hash/fnv"
+	"strings"
+	"sync"
+)
+
+// Number of storage shards
+const threadShards = 32
+
+// Mail threads by queue id and postfix instance. Queue id is unique
+// within the instance queue only, so instances may log the same id
+type threadMap map[string]map[string]*MailThread
+
+// Get thread key: queue id with the instance prefix if any
+func threadKey(instance, id string) string {
+	if instance == "" {
+		return id
+	}
+
+	return instance + "/" + id
+}
+
+// Split thread key to instance and queue id
+func splitKey(key string) (instance, id string) {
+	if i := strings.LastIndexByte(key, '/'); i >= 0 {
+		return key[:i], key[i+1:]
+	}
+
+	return "", key
+}
+
+// Get thread of the instance
+func (this threadMap) get(instance, id string) *MailThread {
+	return this[id][instance]
+}
+
+// Find thread by queue id, thread of the instance is preferred,
+// otherwise the only thread with the id is returned
+func (this threadMap) find(instance, id string) *MailThread {
+	set := this[id]
+
+	if m, ok := set[instance]; ok {
+		return m
+	}
+
+	if len(set) == 1 {
+		for _, m := range set {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// Add thread
+func (this threadMap) put(m *MailThread) {
+	set, ok := this[m.Id]
+	if !ok {
+		set = make(map[string]*MailThread)
+		this[m.Id] = set
+	}
+
+	set[m.Instance] = m
+}
+
+// Remove thread
+func (this threadMap) remove(m *MailThread) {
+	if set, ok := this[m.Id]; ok && set[m.Instance] == m {
+		delete(set, m.Instance)
+
+		if len(set) == 0 {
+			delete(this, m.Id)
+		}
+	}
+}
+
+// Get threads count
+func (this threadMap) len() (n int) {
+	for _, set := range this {
+		n += len(set)
+	}
+
+	return n
+}
+
+// Shard of the threads with its own lock
+type threadShard struct {
+	mu   sync.RWMutex
+	data threadMap
+}
+
+// Threads sharded by queue id, all instances of the queue id are kept
+// in one shard. Shard lock guards the shard map only, it is taken after
+// the storage lock and released before the next shard is locked
+type shardMap []*threadShard
+
+// Create shards
+func newShardMap(n int) shardMap {
+	this := make(shardMap, n)
+
+	for i := range this {
+		this[i] = &threadShard{data: make(threadMap)}
+	}
+
+	return this
+}
+
+// Get shard of the queue id
+func (this shardMap) of(id string) *threadShard {
+	h := fnv.New32a()
+	h.Write([]byte(id))
+
+	return this[h.Sum32()%uint32(len(this))]
+}
+
+// Get thread of the instance
+func (this shardMap) get(instance, id string) *MailThread {
+	s := this.of(id)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.data.get(instance, id)
+}
+
+// Find thread by queue id, see threadMap.find
+func (this shardMap) find(instance, id string) *MailThread {
+	s := this.of(id)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return s.data.find(instance, id)
+}
+
+// Get count of the instance threads with queue id
+func (this shardMap) count(id string) int {
+	s := this.of(id)
+
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+
+	return len(s.data[id])
+}
+
+// Add thread
+func (this shardMap) put(m *MailThread) {
+	s := this.of(m.Id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.put(m)
+}
+
+// Remove thread
+func (this shardMap) remove(m *MailThread) {
+	s := this.of(m.Id)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.data.remove(m)
+}
+
+// Get threads count
+func (this shardMap) len() (n int) {
+	for _, s := range this {
+		s.mu.RLock()
+		n += s.data.len()
+		s.mu.RUnlock()
+	}
+
+	return n
+}
+
+// Run fn for each thread, fn must not lock shards
+func (this shardMap) each(fn func(m *MailThread)) {
+	for _, s := range this {
+		s.mu.RLock()
+		for _, set := range s.data {
+			for _, m := range set {
+				fn(m)
+			}
+		}
+		s.mu.RUnlock()
+	}
+}
@@ -0,0 +1,149 @@
+package filter
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	// Allowed difference between wall clock and log line time
+	timeSkew = 24 * time.Hour
+	// Log line time shift to be considered as year rollover
+	timeRollover = 183 * 24 * time.Hour
+)
+
+// Default log line time parser, parallel workers do not move its reference,
+// so the guessed year does not depend on the parse order
+var lineTime = NewTimeParser(time.Local)
+
+// Log line time parser. Traditional syslog stamp has no year
+// so it is guessed relative to the previous parsed line
+type TimeParser struct {
+	mu   sync.Mutex
+	last time.Time
+	loc  *time.Location
+}
+
+// Create time parser, stamps without zone are read in the given location
+func NewTimeParser(loc *time.Location) *TimeParser {
+	if loc == nil {
+		loc = time.Local
+	}
+
+	return &TimeParser{
+		loc: loc,
+	}
+}
+
+// Set reference time to guess the year of the next line,
+// zero value resets reference to the wall clock
+func SetTimeReference(t time.Time) {
+	lineTime.SetReference(t)
+}
+
+// Set reference time to guess the year of the next line
+func (this *TimeParser) SetReference(t time.Time) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.last = t
+}
+
+// Get time object from the log line, lines are parsed in the log order
+func (this *TimeParser) Parse(str string) (t time.Time, err error) {
+	return this.parse(str, true)
+}
+
+// Get time object from the log line, reference is moved if keep
+func (this *TimeParser) parse(str string, keep bool) (t time.Time, err error) {
+	var (
+		res []string
+	)
+
+	res = timeRe.FindStringSubmatch(str)
+	if len(res) < 2 {
+		return t, ErrorStrFormatNotSupported
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	// RFC 3339 and RFC 5424 time has year and zone
+	if res[1][0] >= '0' && res[1][0] <= '9' {
+		if t, err = time.Parse(time.RFC3339Nano, res[1]); err == nil && keep {
+			this.last = t
+		}
+
+		return
+	}
+
+	if t, err = time.ParseInLocation(time.Stamp, res[1], this.loc); err != nil {
+		return
+	}
+
+	if this.last.IsZero() {
+		// Line can not be logged in the future
+		if t = withYear(t, time.Now().Year()); t.After(time.Now().Add(timeSkew)) {
+			t = withYear(t, t.Year()-1)
+		}
+	} else {
+		t = withYear(t, this.last.Year())
+
+		switch d := t.Sub(this.last); true {
+		case d < -timeRollover:
+			t = withYear(t, t.Year()+1)
+
+		case d > timeRollover:
+			t = withYear(t, t.Year()-1)
+		}
+	}
+
+	if keep {
+		this.last = t
+	}
+
+	return
+}
+
+// Set log time guessed in the log order to the parsed line result,
+// parser result has the time of the same line stamp
+func setLineTime(v interface{}, t time.Time) {
+	if t.IsZero() {
+		return
+	}
+
+	switch v := v.(type) {
+	case *MailThread:
+		if !v.seen.IsZero() {
+			v.seen = t
+		}
+
+		if v.Client != nil && !v.Client.At.IsZero() {
+			v.Client.At = t
+		}
+
+		if v.bounce != nil {
+			setLineTime(v.bounce, t)
+		}
+
+	case *Reject:
+		if v.Client != nil && !v.Client.At.IsZero() {
+			v.Client.At = t
+		}
+
+	case *ScreenEvent:
+		if v.Client != nil && !v.Client.At.IsZero() {
+			v.Client.At = t
+		}
+
+	case *Spam:
+		if !v.at.IsZero() {
+			v.at = t
+		}
+	}
+}
+
+// Replace year value
+func withYear(t time.Time, year int) time.Time {
+	return time.Date(year, t.Month(), t.Day(), t.Hour(), t.Minute(), t.Second(), t.Nanosecond(), t.Location())
+}
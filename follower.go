@@ -0,0 +1,282 @@
+package main
+
+import (
+	"bufio"
+	"hash/fnv"
+	"io"
+	"os"
+	"path/filepath"
+	"postlog-sa/filter"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Interval to check the file for new lines and rotation
+var followPoll = 250 * time.Millisecond
+
+// Log file follower which knows the position of each line, so reading
+// resumes from the checkpoint after restart and rotation
+type Follower struct {
+	name string
+	pos  filter.Checkpoint
+	poll time.Duration
+	stop chan struct{}
+	// Incomplete line at the end of file
+	partial []byte
+
+	Lines chan *filter.Line
+}
+
+// Create follower and start reading from the checkpoint, the file is read
+// from the beginning if there is no checkpoint or it does not match the file
+func NewFollower(name string, cp *filter.Checkpoint) *Follower {
+	var this = &Follower{
+		name:  name,
+		pos:   filter.Checkpoint{File: name},
+		poll:  followPoll,
+		stop:  make(chan struct{}),
+		Lines: make(chan *filter.Line, 1024),
+	}
+
+	go this.run(cp)
+
+	return this
+}
+
+// Stop reading, Lines channel is closed then
+func (this *Follower) Stop() {
+	close(this.stop)
+}
+
+// Check if follower was stopped
+func (this *Follower) stopped() bool {
+	select {
+	case <-this.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+// Wait for the next poll, false is returned if follower was stopped
+func (this *Follower) wait() bool {
+	select {
+	case <-this.stop:
+		return false
+	case <-time.After(this.poll):
+		return true
+	}
+}
+
+func (this *Follower) run(cp *filter.Checkpoint) {
+	var (
+		f   *os.File
+		err error
+	)
+
+	defer close(this.Lines)
+
+	if cp != nil && cp.File == this.name {
+		f = this.resume(cp)
+	}
+
+	for {
+		if f == nil {
+			if f, err = os.Open(this.name); err != nil {
+				if !this.wait() {
+					return
+				}
+
+				continue
+			}
+
+			this.pos = filter.Checkpoint{File: this.name, Inode: inode(f)}
+			this.partial = nil
+		}
+
+		if !this.follow(f) {
+			f.Close()
+
+			return
+		}
+
+		f = nil
+	}
+}
+
+// Open the file at the checkpoint, lines left in the rotated file are read
+// first. Nil is returned if reading starts from the beginning of the file
+func (this *Follower) resume(cp *filter.Checkpoint) *os.File {
+	var (
+		f   *os.File
+		err error
+	)
+
+	if f, err = os.Open(this.name); err == nil && inode(f) == cp.Inode {
+		if seek(f, cp) {
+			this.pos = *cp
+
+			return f
+		}
+
+		log.Warn("File %s was truncated, reading from the beginning", this.name)
+		f.Close()
+
+		return nil
+	}
+
+	if f != nil {
+		f.Close()
+	}
+
+	// File was rotated while stopped
+	if f = findRotated(this.name, cp); f == nil {
+		log.Warn("Rotated file %s is not found, lines after the checkpoint are lost", this.name)
+
+		return nil
+	}
+
+	log.Info("Reading rest of the rotated file %s", f.Name())
+
+	this.pos = *cp
+	this.read(bufio.NewReader(f), true)
+	f.Close()
+
+	return nil
+}
+
+// Read the file until it is rotated or follower is stopped
+func (this *Follower) follow(f *os.File) bool {
+	var (
+		r = bufio.NewReader(f)
+	)
+
+	for {
+		if !this.read(r, false) {
+			return false
+		}
+
+		if !this.wait() {
+			return false
+		}
+
+		fi, err := os.Stat(this.name)
+		cur, _ := f.Stat()
+
+		switch {
+		case err == nil && cur != nil && !os.SameFile(fi, cur):
+			// Lines written before rotation
+			this.read(r, true)
+			f.Close()
+
+			return true
+
+		case cur != nil && cur.Size() < this.pos.Offset:
+			log.Warn("File %s was truncated, reading from the beginning", this.name)
+
+			f.Seek(0, io.SeekStart)
+			r.Reset(f)
+			this.pos.Offset = 0
+			this.partial = nil
+		}
+	}
+}
+
+// Send lines until the end of file, incomplete last line is kept
+// until it is complete unless the file is not written anymore
+func (this *Follower) read(r *bufio.Reader, last bool) bool {
+	for {
+		if this.stopped() {
+			return false
+		}
+
+		b, err := r.ReadBytes('\n')
+		this.partial = append(this.partial, b...)
+
+		// Position is not moved until the line is complete
+		if err != nil && (!last || len(this.partial) == 0) {
+			return true
+		}
+
+		this.pos.Offset += int64(len(this.partial))
+		this.pos.Hash = hashLine(this.partial)
+		this.pos.Length = len(this.partial)
+
+		this.Lines <- &filter.Line{
+			Text:   strings.TrimSuffix(string(this.partial), "\n"),
+			Source: this.name,
+			Pos:    this.pos,
+		}
+
+		this.partial = nil
+
+		if err != nil {
+			return true
+		}
+	}
+}
+
+// Find rotated file by the checkpoint inode and seek to the checkpoint
+func findRotated(name string, cp *filter.Checkpoint) *os.File {
+	var (
+		list, _ = filepath.Glob(name + "?*")
+	)
+
+	for _, v := range list {
+		f, err := os.Open(v)
+		if err != nil {
+			continue
+		}
+
+		if inode(f) == cp.Inode && seek(f, cp) {
+			return f
+		}
+
+		f.Close()
+	}
+
+	return nil
+}
+
+// Seek to the checkpoint if the line before it has the same hash
+func seek(f *os.File, cp *filter.Checkpoint) bool {
+	var (
+		buf = make([]byte, cp.Length)
+	)
+
+	if cp.Offset == 0 {
+		return true
+	}
+
+	if cp.Length == 0 || int64(cp.Length) > cp.Offset {
+		return false
+	}
+
+	if _, err := f.ReadAt(buf, cp.Offset-int64(cp.Length)); err != nil || hashLine(buf) != cp.Hash {
+		return false
+	}
+
+	_, err := f.Seek(cp.Offset, io.SeekStart)
+
+	return err == nil
+}
+
+// Get inode number of the opened file
+func inode(f *os.File) uint64 {
+	if fi, err := f.Stat(); err == nil {
+		if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+			return uint64(st.Ino)
+		}
+	}
+
+	return 0
+}
+
+// Get line hash
+func hashLine(b []byte) uint64 {
+	h := fnv.New64a()
+	h.Write(b)
+
+	return h.Sum64()
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"postlog-sa/filter"
+	"testing"
+	"time"
+)
+
+// Read lines from the follower or fail on timeout
+func followerLines(t *testing.T, fl *Follower, n int) (v []*filter.Line) {
+	for len(v) < n {
+		select {
+		case l := <-fl.Lines:
+			v = append(v, l)
+
+		case <-time.After(2 * time.Second):
+			t.Fatalf("Expected %d lines, but got %d", n, len(v))
+		}
+	}
+
+	return v
+}
+
+func appendFile(t *testing.T, name, str string) {
+	f, err := os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	f.WriteString(str)
+	f.Close()
+}
+
+func TestFollower(t *testing.T) {
+	var (
+		name = filepath.Join(t.TempDir(), "maillog")
+		fl   *Follower
+		cp   filter.Checkpoint
+	)
+
+	followPoll = 10 * time.Millisecond
+
+	appendFile(t, name, "line 1\nline 2\nline")
+
+	fl = NewFollower(name, nil)
+
+	v := followerLines(t, fl, 2)
+	if v[0].Text != "line 1" || v[1].Text != "line 2" || v[1].Pos.Offset != 14 {
+		t.Errorf("Expected two lines at offset 14, but got %s, %s at %d", v[0].Text, v[1].Text, v[1].Pos.Offset)
+	}
+
+	// Incomplete line is sent when it is complete
+	appendFile(t, name, " 3\n")
+
+	if v = followerLines(t, fl, 1); v[0].Text != "line 3" || v[0].Pos.Offset != 21 {
+		t.Errorf("Expected line 3 at offset 21, but got %s at %d", v[0].Text, v[0].Pos.Offset)
+	}
+
+	cp = v[0].Pos
+
+	// Rotation
+	appendFile(t, name, "line 4\n")
+	followerLines(t, fl, 1)
+
+	os.Rename(name, name+".1")
+	appendFile(t, name, "line 5\n")
+
+	if v = followerLines(t, fl, 1); v[0].Text != "line 5" || v[0].Pos.Offset != 7 {
+		t.Errorf("Expected line 5 at offset 7, but got %s at %d", v[0].Text, v[0].Pos.Offset)
+	}
+
+	fl.Stop()
+
+	for range fl.Lines {
+	}
+
+	// Resume from the checkpoint, rest of the rotated file is read first
+	fl = NewFollower(name, &cp)
+
+	if v = followerLines(t, fl, 2); v[0].Text != "line 4" || v[1].Text != "line 5" {
+		t.Errorf("Expected lines 4 and 5, but got %s, %s", v[0].Text, v[1].Text)
+	}
+
+	fl.Stop()
+
+	for range fl.Lines {
+	}
+
+	// Checkpoint does not match the file
+	cp.Hash++
+
+	os.Remove(name + ".1")
+	fl = NewFollower(name, &cp)
+
+	if v = followerLines(t, fl, 1); v[0].Text != "line 5" {
+		t.Errorf("Expected file is read from the beginning, but got %s", v[0].Text)
+	}
+
+	fl.Stop()
+}
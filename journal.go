@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"hash/fnv"
+	"os"
+	"postlog-sa/filter"
+	"time"
+)
+
+// Threads written to the database since the last checkpoint. Lines after
+// the checkpoint are read again after crash, threads found in the journal
+// are not reported twice
+type Journal struct {
+	name string
+	f    *os.File
+	ttl  time.Duration
+
+	// Threads reported before crash and not read again yet
+	replay map[uint64]time.Time
+}
+
+// Open journal and read threads reported before crash, replayed thread
+// which is not read again within time to live is forgotten
+func OpenJournal(name string, ttl time.Duration) (this *Journal, err error) {
+	var (
+		f *os.File
+	)
+
+	this = &Journal{
+		name:   name,
+		ttl:    ttl,
+		replay: make(map[uint64]time.Time),
+	}
+
+	if f, err = os.Open(name); err == nil {
+		s := bufio.NewScanner(f)
+
+		for s.Scan() {
+			var (
+				key uint64
+				at  int64
+			)
+
+			if n, _ := fmt.Sscanf(s.Text(), "%x %d", &key, &at); n == 2 {
+				this.replay[key] = time.Unix(at, 0)
+			}
+		}
+
+		f.Close()
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	if this.f, err = os.OpenFile(name, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+
+	return this, nil
+}
+
+// Check if thread was reported before crash, thread is reported once
+func (this *Journal) Reported(item filter.ThreadFace) bool {
+	key := journalKey(item)
+
+	if _, ok := this.replay[key]; ok {
+		delete(this.replay, key)
+
+		return true
+	}
+
+	return false
+}
+
+// Add reported thread, record is synced to disk. Thread is reported twice
+// only if crash happens between database write and the record
+func (this *Journal) Add(item filter.ThreadFace) (err error) {
+	if _, err = fmt.Fprintf(this.f, "%x %d\n", journalKey(item), time.Now().Unix()); err != nil {
+		return err
+	}
+
+	return this.f.Sync()
+}
+
+// Forget threads reported before the checkpoint was written, threads of
+// the replay are kept until they are read again
+func (this *Journal) Reset() (err error) {
+	var (
+		now = time.Now()
+	)
+
+	if err = this.f.Truncate(0); err != nil {
+		return err
+	}
+
+	for key, at := range this.replay {
+		if this.ttl > 0 && now.Sub(at) > this.ttl {
+			delete(this.replay, key)
+
+			continue
+		}
+
+		if _, err = fmt.Fprintf(this.f, "%x %d\n", key, at.Unix()); err != nil {
+			return err
+		}
+	}
+
+	return this.f.Sync()
+}
+
+// Close journal file
+func (this *Journal) Close() error {
+	return this.f.Close()
+}
+
+// Get thread key
+func journalKey(item filter.ThreadFace) uint64 {
+	h := fnv.New64a()
+
+	fmt.Fprintf(h, "%s %s %s %s", item.GetId(), item.GetTime().Format(time.RFC3339Nano), item.GetFromIp(), item.GetTo())
+
+	return h.Sum64()
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"postlog-sa/filter"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJournal(t *testing.T) {
+	var (
+		name = filepath.Join(t.TempDir(), "state.journal")
+		a    = &filter.MailThread{Id: "A1", Client: &filter.Client{IP: "1.1.1.1", At: time.Now()}}
+		b    = &filter.MailThread{Id: "B1", Client: &filter.Client{IP: "2.2.2.2", At: time.Now()}}
+	)
+
+	jr, err := OpenJournal(name, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	// Reported before the checkpoint
+	jr.Add(a)
+	jr.Reset()
+
+	// Reported after the checkpoint, then crash
+	jr.Add(b)
+	jr.Close()
+
+	if jr, err = OpenJournal(name, time.Hour); err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	if jr.Reported(a) {
+		t.Errorf("Expected thread reported before the checkpoint is not in the journal")
+	}
+
+	// Replay is kept by the checkpoint until it is read again
+	jr.Reset()
+
+	if !jr.Reported(b) || jr.Reported(b) {
+		t.Errorf("Expected thread of the replay is skipped once")
+	}
+
+	jr.Reset()
+	jr.Close()
+
+	if v, _ := ioutil.ReadFile(name); strings.TrimSpace(string(v)) != "" {
+		t.Errorf("Expected empty journal, but got %s", v)
+	}
+}
+
+func TestThreadCompleteJournal(t *testing.T) {
+	var (
+		name = filepath.Join(t.TempDir(), "state.journal")
+		m    = &filter.MailThread{Id: "A1", SpamScore: 1, Client: &filter.Client{IP: "1.1.1.1", At: time.Now()}}
+	)
+
+	ioutil.WriteFile(name, nil, 0644)
+
+	jr, err := OpenJournal(name, time.Hour)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	jr.Add(m)
+	jr.Close()
+
+	jr, _ = OpenJournal(name, time.Hour)
+	defer jr.Close()
+
+	threadComplete(m, jr)
+
+	if _, ok := jr.replay[journalKey(m)]; ok {
+		t.Errorf("Expected thread of the replay is skipped by the callback")
+	}
+}
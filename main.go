@@ -2,8 +2,12 @@ package main
 
 import (
 	"flag"
-	"github.com/hpcloud/tail"
+	"os"
+	"os/signal"
 	"postlog-sa/filter"
+	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
@@ -16,9 +20,12 @@ func init() {
 func main() {
 	var (
 		err error
-		tl  *tail.Tail
+		srv *SyslogServer
+		jr  *Journal
 		st  *filter.Storage
 		sm  *StmtMap
+		sd  *filter.SaslDetector
+		pl  *filter.Pipeline
 	)
 	defer log.Close()
 
@@ -46,6 +53,16 @@ func main() {
 
 	}
 
+	// Postfix instances syslog_name patterns
+	if Cfg.Postfix.SyslogName != "" {
+		filter.SetSyslogNames(strings.Split(Cfg.Postfix.SyslogName, ","))
+	}
+
+	// Amavis content categories counted as spam
+	if Cfg.Amavis.Categories != "" {
+		filter.SetSpamCategories(strings.Split(Cfg.Amavis.Categories, ","))
+	}
+
 	// Create databse connection
 	if src, src_err := NewDBUrl(Cfg); src_err != nil {
 		log.Error(src_err.Error())
@@ -72,63 +89,286 @@ func main() {
 	// Send greeting
 	greeting(log)
 
-	tl, err = tail.TailFile(Cfg.Tail.File, tail.Config{
-		Follow: true,
-		ReOpen: true,
-		Logger: log,
-	})
+	// Authenticated users activity detector
+	if Cfg.CanSasl() {
+		sd = filter.NewSaslDetector(Cfg.Sasl.Window, Cfg.Sasl.Spam, Cfg.Sasl.Recipients)
+	}
 
-	if err != nil {
-		log.Critical(err.Error())
+	// User defined rules are checked after built-in parsers
+	for _, r := range Cfg.Rules {
+		if err = filter.RegisterParser(r); err != nil {
+			log.Warn("Rule %s: %s", r.Name(), err.Error())
+		}
 	}
 
+	// Enable or disable log parsers by the configuration sections
+	for name, v := range Cfg.Parsers {
+		if err = filter.EnableParser(name, v); err != nil {
+			log.Warn("Parser %s: %s", name, err.Error())
+		}
+	}
+
+	// Completion stage
+	done := make(chan func(), 1024)
+	finished := make(chan struct{})
+	go func() {
+		for fn := range done {
+			fn()
+		}
+
+		close(finished)
+	}()
+
 	// Create storage
 	st = filter.NewStorage()
 	// Create callback
-	st.SetThreadDoneCb(threadComplete)
+	st.SetTTL(Cfg.Storage.TTL)
+	st.SetMaxThreads(Cfg.Storage.MaxThreads)
+	st.SetPendingWindow(Cfg.Storage.PendingWindow)
+	st.SetCompleteWindow(Cfg.Storage.CompleteWindow)
+	st.SetScreenWindow(Cfg.Storage.ScreenWindow)
+	st.SetSourceIdle(Cfg.Storage.SourceIdle)
+	st.SetThreadDoneCb(completion(done, threadComplete))
+	st.SetEventCb(completion(done, eventComplete))
+
+	pl = filter.NewPipeline(st, Cfg.Tail.Workers)
+	pl.SetResultCb(func(line *filter.Line, v interface{}, err error) {
+		if err = parseResult(v, err); err != nil {
+			log.Error(err.Error())
+		}
+	})
 
-	for line := range tl.Lines {
-		log.Debug("Parsing:{%s}", line.Text)
+	// Backfill from the rotated files, state is not used
+	if BATCH {
+		batch(st, pl, flag.Args(), sm, Cfg, sd)
+		close(done)
+		<-finished
 
-		if err = parseLine(st, line.Text, sm, Cfg); err != nil {
-			log.Error(err.Error())
+		summary(os.Stdout, st, sm)
+
+		return
+	}
+
+	// Restore threads which were in flight on the previous stop
+	if Cfg.Storage.StateFile != "" {
+		if err = st.LoadFile(Cfg.Storage.StateFile); err != nil {
+			log.Warn("State file %s is discarded: %s", Cfg.Storage.StateFile, err.Error())
+		} else {
+			log.Info("Restored %d threads from %s", st.Len(), Cfg.Storage.StateFile)
+		}
+
+		// Threads reported after the last checkpoint
+		if jr, err = OpenJournal(Cfg.Storage.StateFile+".journal", Cfg.Storage.TTL); err != nil {
+			log.Critical(err.Error())
 		}
+
+		defer jr.Close()
 	}
-}
 
-// Agregate log entries to object with full information to analyze mail
-func parseLine(store *filter.Storage, line string, args ...interface{}) (err error) {
 	var (
-		mi *filter.MailThread
-		sp *filter.Spam
+		files  = Cfg.GetFiles()
+		inputs []<-chan *filter.Line
+		stops  []func()
+		cps    = make(map[string]*filter.Checkpoint)
+		list   = st.GetCheckpoints()
 	)
 
-	mi, err = filter.NewMailThread(line)
-	if err == nil {
-		// Write to storage
-		store.Set(mi)
-	} else {
-		if err != filter.ErrorStrFormatNotSupported {
-			return err
+	// Continue reading from the log positions of the restored state
+	for i := range list {
+		cps[list[i].File] = &list[i]
+	}
+
+	for _, name := range files {
+		fl := NewFollower(name, cps[name])
+
+		inputs = append(inputs, fl.Lines)
+		stops = append(stops, fl.Stop)
+	}
+
+	// Receive messages from syslog clients
+	if listen := Cfg.GetListen(); len(listen) > 0 {
+		if srv, err = NewSyslogServer(listen, Cfg.Syslog.Forward); err != nil {
+			log.Critical(err.Error())
 		}
 
-		err = nil
+		inputs = append(inputs, srv.Lines)
+		stops = append(stops, srv.Stop)
+	}
+
+	if len(inputs) == 0 {
+		log.Critical("There is no log file or syslog address to read")
+	}
+
+	// Verdict may come from the other log after its thread was removed
+	if len(inputs) > 1 && Cfg.Storage.CompleteWindow == 0 {
+		log.Info("Complete window is set to pending window %s for %d log inputs", Cfg.Storage.PendingWindow, len(inputs))
+		st.SetCompleteWindow(Cfg.Storage.PendingWindow)
 	}
 
-	if mi == nil {
-		if sp, err = filter.NewSpam(line); err != nil {
-			return err
+	// Stop reading logs on signal, pipeline is drained then. Forward
+	// file is reopened on hangup after rotation
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	go func() {
+		for s := range sig {
+			if s == syscall.SIGHUP {
+				if srv != nil {
+					if err := srv.Reopen(); err != nil {
+						log.Error(err.Error())
+					}
+				}
+
+				continue
+			}
+
+			log.Info("Signal %s received, stopping", s)
+
+			for _, fn := range stops {
+				fn()
+			}
+
+			return
+		}
+	}()
+
+	// Save state with the log position periodically. State is taken with
+	// storage locked and written after callbacks of the threads completed
+	// before, so thread is not reported twice after restart
+	stopped := make(chan struct{})
+	saved := make(chan struct{})
+	go func() {
+		defer close(saved)
+
+		if Cfg.Storage.Checkpoint <= 0 {
+			return
 		}
 
-		if sp != nil {
-			if err = store.SetSpamStat(sp); err == filter.ErrorUnknownSpamItem {
-				log.Warn("Can not idendify mail thread for %v", sp)
+		tk := time.NewTicker(Cfg.Storage.Checkpoint)
+		defer tk.Stop()
+
+		for {
+			select {
+			case <-stopped:
+				return
+
+			case <-tk.C:
+				logCounters(st)
+
+				if Cfg.Storage.StateFile == "" {
+					continue
+				}
+
+				st.Snapshot(func(state []byte) {
+					done <- func() {
+						if err := filter.WriteStateFile(Cfg.Storage.StateFile, state); err != nil {
+							log.Error(err.Error())
+						} else if err = jr.Reset(); err != nil {
+							log.Error(err.Error())
+						}
+					}
+				})
 			}
 		}
+	}()
+
+	// Read log lines of all inputs, each line is tagged by its source
+	var wg sync.WaitGroup
+	lines := make(chan *filter.Line, 1024)
+	for _, in := range inputs {
+		wg.Add(1)
+
+		go func(in <-chan *filter.Line) {
+			defer wg.Done()
+
+			for line := range in {
+				log.Debug("Parsing %s:{%s}", line.Source, line.Text)
+
+				lines <- line
+			}
+		}(in)
+	}
+
+	go func() {
+		wg.Wait()
+		close(lines)
+	}()
+
+	pl.Run(lines, sm, Cfg, sd, jr)
+	close(stopped)
+	<-saved
+	close(done)
+	<-finished
+
+	logCounters(st)
+
+	if Cfg.Storage.StateFile != "" {
+		if err = st.SaveFile(Cfg.Storage.StateFile); err != nil {
+			log.Error(err.Error())
+		} else if err = jr.Reset(); err != nil {
+			log.Error(err.Error())
+		} else {
+			log.Info("Saved %d threads to %s", st.Len(), Cfg.Storage.StateFile)
+		}
+	}
+}
+
+// Log storage counters
+func logCounters(st *filter.Storage) {
+	c := st.GetCounters()
+
+	log.Info(
+		"Threads: %d, incomplete: %d, bounces: %d, backscatter: %d, verdicts: %d, pending: %d, matched: %d, unmatched: %d",
+		c.Threads,
+		c.Expired+c.Evicted+c.Flushed,
+		c.Bounces,
+		c.Backscatter,
+		c.Verdicts,
+		c.Pending,
+		c.Matched,
+		c.Unmatched,
+	)
+}
+
+// Run callbacks one by one apart from parsing, so slow SQL does not stall log reading
+func completion(done chan<- func(), fn func(item filter.ThreadFace, args ...interface{}) error) func(item filter.ThreadFace, args ...interface{}) error {
+	return func(item filter.ThreadFace, args ...interface{}) error {
+		done <- func() {
+			fn(item, args...)
+		}
+
+		return nil
+	}
+}
+
+// Agregate log entries to object with full information to analyze mail
+func parseLine(store *filter.Storage, line string, args ...interface{}) (err error) {
+	return parseResult(store.Parse(line, args...))
+}
+
+// Report parser result which was emitted to the storage
+func parseResult(v interface{}, err error) error {
+	switch err {
+	case nil:
+
+	case filter.ErrorStrFormatNotSupported:
+		return nil
+
+	case filter.ErrorUnknownSpamItem:
+		log.Warn("Can not idendify mail thread for %v", v)
+
+		return nil
+
+	case filter.ErrorAmbiguousSpamItem:
+		log.Warn("Several mail threads match %v", v)
+
+		return nil
+
+	default:
+		return err
 	}
 
-	if mi != nil {
-		store.ThreadDone(mi, args...)
+	if sp, ok := v.(*filter.Spam); ok && !sp.HasId() && len(sp.Viruses) > 0 {
+		log.Info("Virus %s found by %s", strings.Join(sp.Viruses, ","), sp.Scanner)
 	}
 
 	return nil
@@ -143,31 +383,148 @@ func threadComplete(item filter.ThreadFace, args ...interface{}) (err error) {
 	var (
 		sm *StmtMap
 		cf *Config
+		sd *filter.SaslDetector
+		jr *Journal
 	)
 
-	if item.GetSpamScore() > 0 {
+	// Dereference arguments
+	for _, a := range args {
+		switch a.(type) {
+		case *StmtMap:
+			sm = a.(*StmtMap)
+		case *Config:
+			cf = a.(*Config)
+		case *filter.SaslDetector:
+			sd = a.(*filter.SaslDetector)
+		case *Journal:
+			jr = a.(*Journal)
+		}
+	}
+
+	// Lines after the checkpoint are read again after crash
+	if jr != nil && jr.Reported(item) {
+		log.Debug("Thread %s was reported before restart", item.GetId())
+
+		return
+	}
+
+	if sd != nil {
+		if v := sd.Check(item); v != nil {
+			log.Warn(
+				"Account %s may be compromised: spam %d, recipients %d since %s",
+				v.User,
+				v.Spam,
+				v.Recipients,
+				v.Since.Format(time.Stamp),
+			)
+		}
+	}
+
+	if m, ok := item.(*filter.MailThread); ok && m.IsBackscatter() {
+		log.Warn("Backscatter %s to %s, notification of spam %s", item.GetId(), item.GetTo(), item.GetBounceOf())
+	}
+
+	if m, ok := item.(*filter.MailThread); ok && m.IsIncomplete() {
+		log.Debug("Thread %s expired without removed line", item.GetId())
+	}
+
+	if item.GetSpamScore() > 0 || item.IsInfected() {
 		log.Info(
-			"ID: %s, at: %s, from: %s, IP: %s, score: %d",
+			"ID: %s, instance: %s, at: %s, from: %s, IP: %s, uid: %s, score: %d, hits: %.2f/%.2f, viruses: %s",
 			item.GetId(),
+			item.GetInstance(),
 			item.GetTime().Format(time.Stamp),
 			item.GetFrom(),
 			item.GetFromIp(),
+			item.GetUid(),
 			item.GetSpamScore(),
+			item.GetSpamHits(),
+			item.GetSpamRequired(),
+			item.GetViruses(),
 		)
 
-		// Dereference arguments
-		for _, a := range args {
-			switch a.(type) {
-			case *StmtMap:
-				sm = a.(*StmtMap)
-			case *Config:
-				cf = a.(*Config)
+		if cf != nil && sm != nil && cf.CanSql() {
+			if err = sm.Call(item); err != nil {
+				log.Error(err.Error())
+			} else if jr != nil {
+				if err = jr.Add(item); err != nil {
+					log.Error(err.Error())
+				}
 			}
 		}
-		if cf != nil && sm != nil && cf.CanSql() {
-			err = sm.Call(item)
+	}
 
-			if err != nil {
+	return
+}
+
+func eventComplete(item filter.ThreadFace, args ...interface{}) (err error) {
+	var (
+		sm *StmtMap
+		cf *Config
+		jr *Journal
+	)
+
+	// Dereference arguments
+	for _, a := range args {
+		switch a.(type) {
+		case *StmtMap:
+			sm = a.(*StmtMap)
+		case *Config:
+			cf = a.(*Config)
+		case *Journal:
+			jr = a.(*Journal)
+		}
+	}
+
+	// Lines after the checkpoint are read again after crash
+	if jr != nil && jr.Reported(item) {
+		return
+	}
+
+	switch item.(type) {
+	case *filter.Reject:
+		rj := item.(*filter.Reject)
+
+		log.Info(
+			"Reject %s instance: %s, at: %s, from: %s, to: %s, IP: %s, helo: %s, code: %s %s, reason: %s",
+			rj.Stage,
+			rj.Instance,
+			item.GetTime().Format(time.Stamp),
+			item.GetFrom(),
+			rj.To,
+			item.GetFromIp(),
+			rj.Helo,
+			rj.Code,
+			rj.Dsn,
+			rj.Reason,
+		)
+
+	case *filter.Screen:
+		sc := item.(*filter.Screen)
+
+		// Clean connection passed to smtpd
+		if item.GetSpamScore() == 0 && sc.Rank == 0 {
+			log.Debug("Postscreen %s IP: %s", sc.Result, item.GetFromIp())
+
+			return
+		}
+
+		log.Info(
+			"Postscreen %s instance: %s, at: %s, IP: %s, DNSBL rank: %d, rules: %s",
+			sc.Result,
+			sc.Instance,
+			item.GetTime().Format(time.Stamp),
+			item.GetFromIp(),
+			sc.Rank,
+			item.GetSpamRules(),
+		)
+	}
+
+	if cf != nil && sm != nil && cf.CanSql() && cf.SQL.Events && item.GetSpamScore() > 0 {
+		if err = sm.Call(item); err != nil {
+			log.Error(err.Error())
+		} else if jr != nil {
+			if err = jr.Add(item); err != nil {
 				log.Error(err.Error())
 			}
 		}
@@ -165,3 +165,146 @@ func TestStorageSetMutlipleSmtpd(t *testing.T) {
 		t.Fatalf("Expected one callback execution, but got %d", iter)
 	}
 }
+
+func TestRejectEvent(t *testing.T) {
+	var (
+		m = []string{
+			`Nov 22 03:47:02 mx postfix/smtpd[9032]: connect from unknown[1.2.3.4]`,
+			`Nov 22 03:47:02 mx postfix/smtpd[9032]: NOQUEUE: reject: RCPT from unknown[1.2.3.4]: 554 5.7.1 Service unavailable; Client host [1.2.3.4] blocked using zen.spamhaus.org; from=<spam@foo.net> to=<user@some.net> proto=ESMTP helo=<bot.foo.net>`,
+			`Nov 22 03:47:02 mx postfix/smtpd[9032]: disconnect from unknown[1.2.3.4]`,
+		}
+
+		s    *filter.Storage
+		err  error
+		iter int
+	)
+
+	var fn = func(item filter.ThreadFace, args ...interface{}) error {
+		if v := item.GetFromIp(); v != "1.2.3.4" {
+			t.Errorf("Expected client ip 1.2.3.4, but got %s", v)
+		}
+
+		iter++
+
+		return nil
+	}
+
+	s = filter.NewStorage()
+	s.SetEventCb(fn)
+
+	for _, l := range m {
+		if err = parseLine(s, l); err != nil {
+			t.Errorf("Unexpected error: %s at `%s`", err.Error(), l)
+		}
+	}
+
+	if iter != 1 {
+		t.Errorf("Expected event callback once, but got %d", iter)
+	}
+
+	if v := s.Len(); v != 0 {
+		t.Errorf("Expecte storage length 0, but got %d", v)
+	}
+}
+
+func TestThreadRecipientsFromChild(t *testing.T) {
+	var (
+		m = []string{
+			`Dec  4 10:33:24 mx postfix/smtpd[14247]: 5247C4562029: client=unknown[1.7.1.1]`,
+			`Dec  4 10:33:24 mx postfix/cleanup[14676]: 5247C4562029: message-id=<659691365ACB4CBBA5AD2A0C2E2639E2@ip-1-7-1-1.bb.net.net>`,
+			`Dec  4 10:33:24 mx postfix/qmgr[22753]: 5247C4562029: from=<simonova@yahoo.com>, size=18194, nrcpt=2 (queue active)`,
+			`Dec  4 10:33:24 mx postfix/smtpd[14680]: F3C59456202A: client=localhost[127.0.0.1]`,
+			`Dec  4 10:33:25 mx postfix/cleanup[14676]: F3C59456202A: message-id=<659691365ACB4CBBA5AD2A0C2E2639E2@ip-1-7-1-1.bb.net.net>`,
+			`Dec  4 10:33:25 mx postfix/qmgr[22753]: F3C59456202A: from=<simonova@yahoo.com>, size=19017, nrcpt=2 (queue active)`,
+			`Dec  4 10:33:25 mx postfix/smtp[14678]: 5247C4562029: to=<lik@some.net>, relay=127.0.0.1[127.0.0.1]:10024, delay=1.3, delays=0.67/0/0/0.66, dsn=2.0.0, status=sent (250 2.0.0 from MTA(smtp:[127.0.0.1]:10025): 250 2.0.0 Ok: queued as F3C59456202A)`,
+			`Dec  4 10:33:25 mx postfix/smtp[14678]: 5247C4562029: to=<ochki@some.net>, relay=127.0.0.1[127.0.0.1]:10024, delay=1.3, delays=0.67/0/0/0.66, dsn=2.0.0, status=sent (250 2.0.0 from MTA(smtp:[127.0.0.1]:10025): 250 2.0.0 Ok: queued as F3C59456202A)`,
+			`Dec  4 10:33:25 mx postfix/qmgr[22753]: 5247C4562029: removed`,
+			`Dec  4 10:33:25 mx postfix/pipe[14682]: F3C59456202A: to=<lik@some.net>, relay=dovecot, delay=0.09, delays=0.01/0/0/0.08, dsn=2.0.0, status=sent (delivered via dovecot service)`,
+			`Dec  4 10:33:25 mx postfix/local[14689]: F3C59456202A: to=<ochki@some.net>, relay=local, delay=0.04, delays=0.01/0.01/0/0.02, dsn=5.2.2, status=bounced (cannot update mailbox)`,
+			`Dec  4 10:33:25 mx postfix/qmgr[22753]: F3C59456202A: removed`,
+		}
+
+		s    *filter.Storage
+		err  error
+		iter int
+	)
+
+	var fn = func(item filter.ThreadFace, args ...interface{}) error {
+		for _, r := range item.GetRecipients() {
+			switch r.Address {
+			case "lik@some.net":
+				if r.Relay != "dovecot" || r.Status != filter.StatusSent {
+					t.Errorf("Unexpected delivery %v", r)
+				}
+
+			case "ochki@some.net":
+				if r.Status != filter.StatusBounced {
+					t.Errorf("Expected status %s, but got %s", filter.StatusBounced, r.Status)
+				}
+
+			default:
+				t.Errorf("Unexpected recipient %s", r.Address)
+			}
+		}
+
+		iter++
+
+		return nil
+	}
+
+	s = filter.NewStorage()
+	s.SetThreadDoneCb(fn)
+
+	for _, l := range m {
+		if err = parseLine(s, l); err != nil {
+			t.Errorf("Unexpected error: %s at `%s`", err.Error(), l)
+		}
+	}
+
+	if iter != 1 {
+		t.Errorf("Expected callback once, but got %d", iter)
+	}
+}
+
+func TestInfectedThread(t *testing.T) {
+	var (
+		m = []string{
+			`Oct 18 10:00:00 mx postfix/smtpd[9032]: 4F3A2B1C: client=unknown[1.2.3.4]`,
+			`Oct 18 10:00:00 mx postfix/cleanup[9076]: 4F3A2B1C: message-id=<eicar@foo.net>`,
+			`Oct 18 10:00:02 mx clamav-milter[1234]: Message 4F3A2B1C from <virus@foo.net> to <a@some.net> with subject 'test' message-id '<eicar@foo.net>' date 'Sun, 18 Oct 2026 10:00:00 +0000' infected by Eicar-Signature`,
+			`Oct 18 10:00:02 mx postfix/qmgr[8015]: 4F3A2B1C: from=<virus@foo.net>, size=1755, nrcpt=1 (queue active)`,
+			`Oct 18 10:00:02 mx postfix/qmgr[8015]: 4F3A2B1C: removed`,
+		}
+
+		s    *filter.Storage
+		err  error
+		iter int
+	)
+
+	var fn = func(item filter.ThreadFace, args ...interface{}) error {
+		if !item.IsInfected() || item.GetViruses() != "Eicar-Signature" {
+			t.Errorf("Expected infected thread, but got viruses %s", item.GetViruses())
+		}
+
+		if v := item.GetSpamScore(); v != 0 {
+			t.Errorf("Expected spam score 0, but got %d", v)
+		}
+
+		iter++
+
+		return nil
+	}
+
+	s = filter.NewStorage()
+	s.SetThreadDoneCb(fn)
+
+	for _, l := range m {
+		if err = parseLine(s, l); err != nil {
+			t.Errorf("Unexpected error: %s at `%s`", err.Error(), l)
+		}
+	}
+
+	if iter != 1 {
+		t.Errorf("Expected callback once, but got %d", iter)
+	}
+}
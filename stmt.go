@@ -13,6 +13,8 @@ import (
 type StmtMap struct {
 	stmt   *sql.Stmt
 	params []string
+	// Executed statements
+	rows uint
 }
 
 func (this *StmtMap) Call(fn filter.ThreadFace) (err error) {
@@ -39,10 +41,18 @@ func (this *StmtMap) Call(fn filter.ThreadFace) (err error) {
 		}
 	}
 
-	_, err = this.stmt.Exec(args...)
+	if _, err = this.stmt.Exec(args...); err == nil {
+		this.rows++
+	}
+
 	return
 }
 
+// Get number of rows written, statement is called from the completion stage only
+func (this *StmtMap) GetRows() uint {
+	return this.rows
+}
+
 func NewStmt(db *sql.DB, query string) (stmt *StmtMap, err error) {
 	var (
 		buffer  *bytes.Buffer
@@ -67,24 +77,51 @@ func NewStmt(db *sql.DB, query string) (stmt *StmtMap, err error) {
 		fn_name = ""
 
 		switch r {
+		// a
+		case 97:
+			fn_name = "GetSaslUser"
+		// b
+		case 98:
+			fn_name = "GetBounceOf"
 		// c
 		case 99:
 			fn_name = "GetFromIp"
 		// f
 		case 102:
 			fn_name = "GetFrom"
+		// h
+		case 104:
+			fn_name = "GetSpamHits"
 		// i
 		case 105:
 			fn_name = "GetId"
+		// l
+		case 108:
+			fn_name = "GetSpamRules"
 		// m
 		case 109:
 			fn_name = "GetMessageId"
+		// p
+		case 112:
+			fn_name = "GetInstance"
+		// q
+		case 113:
+			fn_name = "GetSpamRequired"
+		// r
+		case 114:
+			fn_name = "GetTo"
 		// s
 		case 115:
 			fn_name = "GetSpamScore"
 		// t
 		case 116:
 			fn_name = "GetTime"
+		// u
+		case 117:
+			fn_name = "GetUid"
+		// v
+		case 118:
+			fn_name = "GetViruses"
 		}
 
 		if fn_name != "" {
@@ -97,10 +134,19 @@ func NewStmt(db *sql.DB, query string) (stmt *StmtMap, err error) {
 /**
  * GetId - ?i
  * GetMessageId - ?m
+ * GetBounceOf - ?b
+ * GetInstance - ?p
+ * GetTo - ?r
  * GetFrom - ?f
  * GetFromIp - ?c
+ * GetSaslUser - ?a
+ * GetUid - ?u
  * GetTime - ?t
  * GetSpamScore - ?s
+ * GetSpamHits - ?h
+ * GetSpamRequired - ?q
+ * GetSpamRules - ?l
+ * GetViruses - ?v
  */
 func parseStmtQuery(query string) (buffer *bytes.Buffer, runes []rune, err error) {
 	var (
@@ -142,7 +188,7 @@ func parseStmtQuery(query string) (buffer *bytes.Buffer, runes []rune, err error
 			m_pos = -1
 
 			switch char {
-			case 99, 102, 105, 109, 115, 116:
+			case 97, 98, 99, 102, 104, 105, 108, 109, 112, 113, 114, 115, 116, 117, 118:
 				runes = append(runes, char)
 				continue
 			}
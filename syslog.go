@@ -0,0 +1,501 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"postlog-sa/filter"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrorSyslogFormat = errors.New("Syslog message format is not supported")
+
+	// Host name of the local socket messages without host
+	localHost, _ = os.Hostname()
+
+	// BSD syslog stamp has no year, it is guessed by the previous message
+	syslogTime = filter.NewTimeParser(time.Local)
+)
+
+// Syslog message with the parsed header
+type SyslogMessage struct {
+	Priority int
+	Time     time.Time
+	Host     string
+	Program  string
+	Pid      string
+	Text     string
+}
+
+// Parse RFC 3164 or RFC 5424 message
+func ParseSyslog(str string) (m *SyslogMessage, err error) {
+	var (
+		i int
+	)
+
+	str = strings.TrimRight(str, "\r\n\x00")
+
+	if i = strings.IndexByte(str, '>'); !strings.HasPrefix(str, "<") || i < 2 || i > 4 {
+		return nil, ErrorSyslogFormat
+	}
+
+	m = &SyslogMessage{}
+
+	if m.Priority, err = strconv.Atoi(str[1:i]); err != nil {
+		return nil, ErrorSyslogFormat
+	}
+
+	if str = str[i+1:]; strings.HasPrefix(str, "1 ") {
+		err = m.parse5424(str[2:])
+	} else {
+		err = m.parse3164(str)
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+// Parse BSD syslog header: Mmm dd hh:mm:ss [HOST] TAG[PID]: MSG
+func (this *SyslogMessage) parse3164(str string) (err error) {
+	if len(str) < 16 || str[15] != ' ' {
+		return ErrorSyslogFormat
+	}
+
+	if this.Time, err = syslogTime.Parse(str[:15]); err != nil {
+		return ErrorSyslogFormat
+	}
+
+	str = str[16:]
+
+	// Host is omitted by the local socket clients
+	if i := strings.IndexByte(str, ' '); i > 0 && !strings.ContainsAny(str[:i], ":[") {
+		this.Host = str[:i]
+		str = str[i+1:]
+	} else {
+		this.Host = localHost
+	}
+
+	this.Text = str
+
+	if i := strings.IndexByte(str, ' '); i > 1 && str[i-1] == ':' {
+		this.setTag(str[:i-1])
+		this.Text = str[i+1:]
+	}
+
+	return nil
+}
+
+// Parse syslog protocol header: 1 TIMESTAMP HOST APP PROCID MSGID SD [MSG]
+func (this *SyslogMessage) parse5424(str string) (err error) {
+	var (
+		f = strings.SplitN(str, " ", 6)
+	)
+
+	if len(f) < 6 {
+		return ErrorSyslogFormat
+	}
+
+	if f[0] == "-" {
+		this.Time = time.Now()
+	} else if this.Time, err = time.Parse(time.RFC3339Nano, f[0]); err != nil {
+		return ErrorSyslogFormat
+	}
+
+	if this.Host = nilValue(f[1]); this.Host == "" {
+		this.Host = localHost
+	}
+
+	this.Program = nilValue(f[2])
+	this.Pid = nilValue(f[3])
+
+	if str, err = skipStructuredData(f[5]); err != nil {
+		return err
+	}
+
+	this.Text = strings.TrimPrefix(strings.TrimPrefix(str, " "), "\xEF\xBB\xBF")
+
+	return nil
+}
+
+// Split tag to program and pid
+func (this *SyslogMessage) setTag(tag string) {
+	this.Program = tag
+
+	if i := strings.IndexByte(tag, '['); i > 0 && strings.HasSuffix(tag, "]") {
+		this.Program = tag[:i]
+		this.Pid = tag[i+1 : len(tag)-1]
+	}
+}
+
+// Get message in the log file format, time is RFC 3339 with the year and zone
+func (this *SyslogMessage) String() string {
+	var (
+		tag = this.Program
+	)
+
+	if this.Pid != "" {
+		tag += "[" + this.Pid + "]"
+	}
+
+	if tag == "" {
+		return fmt.Sprintf("%s %s %s", this.Time.Format(time.RFC3339Nano), this.Host, this.Text)
+	}
+
+	return fmt.Sprintf("%s %s %s: %s", this.Time.Format(time.RFC3339Nano), this.Host, tag, this.Text)
+}
+
+// Return empty string for the nil value
+func nilValue(v string) string {
+	if v == "-" {
+		return ""
+	}
+
+	return v
+}
+
+// Get message after the structured data elements
+func skipStructuredData(str string) (string, error) {
+	if strings.HasPrefix(str, "-") {
+		return str[1:], nil
+	}
+
+	for strings.HasPrefix(str, "[") {
+		var (
+			quoted bool
+			end    = -1
+		)
+
+		for i := 1; i < len(str) && end < 0; i++ {
+			switch {
+			case str[i] == '\\':
+				i++
+			case str[i] == '"':
+				quoted = !quoted
+			case str[i] == ']' && !quoted:
+				end = i
+			}
+		}
+
+		if end < 0 {
+			return "", ErrorSyslogFormat
+		}
+
+		str = str[end+1:]
+	}
+
+	return str, nil
+}
+
+// Syslog receiver on udp, tcp and unix datagram sockets, messages are sent
+// to the Lines channel in the log file format
+type SyslogServer struct {
+	mu      sync.Mutex
+	wg      sync.WaitGroup
+	stopped bool
+	// Listeners and connections closed on stop
+	closers map[io.Closer]bool
+	addrs   []net.Addr
+
+	// File to write received lines
+	forward string
+	out     *os.File
+
+	Lines chan *filter.Line
+}
+
+// Create receiver listening on addresses like udp://:514, tcp://127.0.0.1:514
+// or unix:///dev/log, received lines are written to the forward file if set
+func NewSyslogServer(listen []string, forward string) (this *SyslogServer, err error) {
+	this = &SyslogServer{
+		closers: make(map[io.Closer]bool),
+		forward: forward,
+		Lines:   make(chan *filter.Line, 1024),
+	}
+
+	if err = this.Reopen(); err != nil {
+		return nil, err
+	}
+
+	for _, addr := range listen {
+		if err = this.listen(addr); err != nil {
+			this.Stop()
+			this.wg.Wait()
+			this.closeForward()
+
+			return nil, err
+		}
+	}
+
+	go func() {
+		this.wg.Wait()
+		close(this.Lines)
+		this.closeForward()
+	}()
+
+	return this, nil
+}
+
+// Stop receiving, Lines channel is closed when all connections are done
+func (this *SyslogServer) Stop() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	this.stopped = true
+
+	for c := range this.closers {
+		c.Close()
+	}
+}
+
+// Open forward file again after rotation
+func (this *SyslogServer) Reopen() (err error) {
+	var (
+		f *os.File
+	)
+
+	if this.forward == "" {
+		return nil
+	}
+
+	if f, err = os.OpenFile(this.forward, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return err
+	}
+
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.out != nil {
+		this.out.Close()
+	}
+
+	this.out = f
+
+	return nil
+}
+
+// Close forward file
+func (this *SyslogServer) closeForward() {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.out != nil {
+		this.out.Close()
+		this.out = nil
+	}
+}
+
+func (this *SyslogServer) listen(addr string) (err error) {
+	var (
+		pc net.PacketConn
+		l  net.Listener
+		u  = strings.SplitN(addr, "://", 2)
+	)
+
+	if len(u) < 2 {
+		return fmt.Errorf("Syslog listen address %s is not valid", addr)
+	}
+
+	switch u[0] {
+	case "udp":
+		if pc, err = net.ListenPacket("udp", u[1]); err != nil {
+			return err
+		}
+
+		this.track(pc, pc.LocalAddr())
+		this.wg.Add(1)
+		go this.readPackets(pc, addr)
+
+	case "unix":
+		// Socket of the previous run
+		os.Remove(u[1])
+
+		if pc, err = net.ListenPacket("unixgram", u[1]); err != nil {
+			return err
+		}
+
+		os.Chmod(u[1], 0666)
+
+		this.track(pc, pc.LocalAddr())
+		this.wg.Add(1)
+		go this.readPackets(pc, addr)
+
+	case "tcp":
+		if l, err = net.Listen("tcp", u[1]); err != nil {
+			return err
+		}
+
+		this.track(l, l.Addr())
+		this.wg.Add(1)
+		go this.accept(l, addr)
+
+	default:
+		return fmt.Errorf("Syslog listen address %s is not supported", addr)
+	}
+
+	return nil
+}
+
+// Keep listener or connection to close on stop, false is returned if stopped
+func (this *SyslogServer) track(c io.Closer, addr net.Addr) bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	if this.stopped {
+		c.Close()
+
+		return false
+	}
+
+	this.closers[c] = true
+
+	if addr != nil {
+		this.addrs = append(this.addrs, addr)
+	}
+
+	return true
+}
+
+func (this *SyslogServer) untrack(c io.Closer) {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	delete(this.closers, c)
+	c.Close()
+}
+
+// Check if server was stopped
+func (this *SyslogServer) isStopped() bool {
+	this.mu.Lock()
+	defer this.mu.Unlock()
+
+	return this.stopped
+}
+
+// Read datagrams, each one is a message
+func (this *SyslogServer) readPackets(pc net.PacketConn, source string) {
+	var (
+		buf = make([]byte, 65536)
+	)
+
+	defer this.wg.Done()
+
+	for {
+		n, _, err := pc.ReadFrom(buf)
+
+		if err != nil {
+			if !this.isStopped() {
+				log.Error("Syslog %s: %s", source, err.Error())
+			}
+
+			return
+		}
+
+		this.receive(string(buf[:n]), source)
+	}
+}
+
+func (this *SyslogServer) accept(l net.Listener, source string) {
+	defer this.wg.Done()
+
+	for {
+		c, err := l.Accept()
+
+		if err != nil {
+			if !this.isStopped() {
+				log.Error("Syslog %s: %s", source, err.Error())
+			}
+
+			return
+		}
+
+		if this.track(c, nil) {
+			this.wg.Add(1)
+			go this.readStream(c, source)
+		}
+	}
+}
+
+// Read octet counted or newline framed messages
+func (this *SyslogServer) readStream(c net.Conn, source string) {
+	var (
+		r = bufio.NewReader(c)
+	)
+
+	defer this.wg.Done()
+	defer this.untrack(c)
+
+	for {
+		b, err := r.Peek(1)
+		if err != nil {
+			return
+		}
+
+		// Octet counting: MSG-LEN SP SYSLOG-MSG
+		if b[0] >= '1' && b[0] <= '9' {
+			str, err := r.ReadString(' ')
+			if err != nil {
+				return
+			}
+
+			n, err := strconv.Atoi(strings.TrimSuffix(str, " "))
+			if err != nil || n > 1<<20 {
+				log.Error("Syslog %s: wrong frame length %s", source, str)
+
+				return
+			}
+
+			msg := make([]byte, n)
+			if _, err = io.ReadFull(r, msg); err != nil {
+				return
+			}
+
+			this.receive(string(msg), source)
+
+			continue
+		}
+
+		str, err := r.ReadString('\n')
+		if str = strings.TrimRight(str, "\r\n\x00"); str != "" {
+			this.receive(str, source)
+		}
+
+		if err != nil {
+			return
+		}
+	}
+}
+
+// Send message to the lines channel and forward file
+func (this *SyslogServer) receive(str string, source string) {
+	m, err := ParseSyslog(str)
+	if err != nil {
+		log.Debug("Syslog %s: %s {%s}", source, err.Error(), str)
+
+		return
+	}
+
+	line := m.String()
+
+	this.mu.Lock()
+	if this.out != nil {
+		if _, err = this.out.WriteString(line + "\n"); err != nil {
+			log.Error("Syslog forward %s: %s", this.forward, err.Error())
+		}
+	}
+	this.mu.Unlock()
+
+	this.Lines <- &filter.Line{
+		Text:   line,
+		Source: source,
+	}
+}
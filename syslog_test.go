@@ -0,0 +1,173 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSyslog(t *testing.T) {
+	var (
+		at = time.Date(2026, 10, 18, 10, 15, 7, 0, time.UTC)
+	)
+
+	syslogTime.SetReference(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+
+	for i, v := range []struct {
+		str,
+		host,
+		program,
+		pid,
+		text string
+		err error
+	}{
+		{
+			str:     `<22>Oct 18 10:15:07 mx postfix/smtpd[9032]: connect from unknown[1.1.1.1]`,
+			host:    "mx",
+			program: "postfix/smtpd",
+			pid:     "9032",
+			text:    "connect from unknown[1.1.1.1]",
+		},
+		// Local socket message without host
+		{
+			str:     `<22>Oct  8 10:15:07 postfix/qmgr[8015]: D549FB08A08B: removed` + "\n",
+			host:    localHost,
+			program: "postfix/qmgr",
+			pid:     "8015",
+			text:    "D549FB08A08B: removed",
+		},
+		{
+			str:     `<22>Oct 18 10:15:07 mx dovecot: imap-login: Login`,
+			host:    "mx",
+			program: "dovecot",
+			text:    "imap-login: Login",
+		},
+		{
+			str:     `<22>1 2026-10-18T10:15:07.003Z mx.example.com postfix/smtpd 9032 - - connect from unknown[1.1.1.1]`,
+			host:    "mx.example.com",
+			program: "postfix/smtpd",
+			pid:     "9032",
+			text:    "connect from unknown[1.1.1.1]",
+		},
+		{
+			str:     `<165>1 2026-10-18T10:15:07Z mx amavis - ID47 [exampleSDID@32473 iut="3" eventID="1011" text="a \"]\" b"][other@1 a="b"] ` + "\xEF\xBB\xBF" + `(09032-01) Blocked SPAM`,
+			host:    "mx",
+			program: "amavis",
+			text:    "(09032-01) Blocked SPAM",
+		},
+		{str: `Oct 18 10:15:07 mx postfix/smtpd[9032]: connect`, err: ErrorSyslogFormat},
+		{str: `<22>1 2026-10-18 mx`, err: ErrorSyslogFormat},
+		{str: `<22>1 2026-10-18T10:15:07Z mx app - - [unterminated msg`, err: ErrorSyslogFormat},
+	} {
+		m, err := ParseSyslog(v.str)
+
+		if err != v.err {
+			t.Errorf("%d: expected error %v, but got %v", i, v.err, err)
+
+			continue
+		}
+
+		if err != nil {
+			continue
+		}
+
+		if m.Host != v.host || m.Program != v.program || m.Pid != v.pid || m.Text != v.text {
+			t.Errorf("%d: unexpected message %#v", i, m)
+		}
+
+		// Year is guessed by the previous message
+		if i == 0 && !m.Time.Equal(time.Date(2026, 10, 18, 10, 15, 7, 0, time.Local)) {
+			t.Errorf("%d: unexpected time %s", i, m.Time)
+		}
+
+		if i == 3 && !m.Time.Equal(at.Add(3*time.Millisecond)) {
+			t.Errorf("%d: unexpected time %s", i, m.Time)
+		}
+	}
+}
+
+func TestSyslogMessageString(t *testing.T) {
+	var (
+		m = &SyslogMessage{
+			Time:    time.Date(2026, 10, 8, 10, 15, 7, 0, time.FixedZone("", 3*3600)),
+			Host:    "mx",
+			Program: "postfix/smtpd",
+			Pid:     "9032",
+			Text:    "connect from unknown[1.1.1.1]",
+		}
+	)
+
+	if v := m.String(); v != `2026-10-08T10:15:07+03:00 mx postfix/smtpd[9032]: connect from unknown[1.1.1.1]` {
+		t.Errorf("Unexpected line %s", v)
+	}
+}
+
+func TestSyslogServer(t *testing.T) {
+	var (
+		dir     = t.TempDir()
+		sock    = filepath.Join(dir, "log")
+		forward = filepath.Join(dir, "mail.log")
+		msg     = `<22>Oct 18 10:15:07 mx postfix/smtpd[9032]: connect from unknown[1.1.1.1]`
+		line    = time.Date(2026, 10, 18, 10, 15, 7, 0, time.Local).Format(time.RFC3339Nano) + ` mx postfix/smtpd[9032]: connect from unknown[1.1.1.1]`
+	)
+
+	syslogTime.SetReference(time.Date(2026, 10, 18, 0, 0, 0, 0, time.Local))
+
+	srv, err := NewSyslogServer([]string{"udp://127.0.0.1:0", "tcp://127.0.0.1:0", "unix://" + sock}, forward)
+	if err != nil {
+		t.Fatalf("Unexpected error %s", err.Error())
+	}
+
+	send := func(network, addr, str string) {
+		c, err := net.Dial(network, addr)
+		if err != nil {
+			t.Fatalf("Unexpected error %s", err.Error())
+		}
+
+		c.Write([]byte(str))
+		c.Close()
+	}
+
+	receive := func(n int) (v []string) {
+		for len(v) < n {
+			select {
+			case l := <-srv.Lines:
+				v = append(v, l.Text)
+
+			case <-time.After(2 * time.Second):
+				t.Fatalf("Expected %d lines, but got %d", n, len(v))
+			}
+		}
+
+		return v
+	}
+
+	send("udp", srv.addrs[0].String(), msg)
+	send("unixgram", sock, msg)
+
+	// Octet counted and newline framed messages in the same stream
+	send("tcp", srv.addrs[1].String(), fmt.Sprintf("%d %s%s\n%s\n", len(msg), msg, msg, "not syslog"))
+
+	for i, v := range receive(4) {
+		if v != line {
+			t.Errorf("%d: unexpected line %s", i, v)
+		}
+	}
+
+	srv.Stop()
+
+	for range srv.Lines {
+	}
+
+	if b, err := ioutil.ReadFile(forward); err != nil || strings.Count(string(b), line+"\n") != 4 {
+		t.Errorf("Expected forwarded lines, but got %s", b)
+	}
+
+	if _, err := NewSyslogServer([]string{"ftp://:21"}, ""); err == nil {
+		t.Errorf("Expected error on unsupported address")
+	}
+}